@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeRARP = 0x8035
+	arpRequest    = 1
+	rarpRequest   = 3
+)
+
+// cmdAnnounce makes the network learn that a MAC address moved to a container
+// port, e.g. after a VM live-migrated into the container. It is meant to be
+// called by a migration hook once the move completed:
+//
+//	rainier announce <containerID> <mac> [ipv4 ...]
+//
+// A RARP and one gratuitous ARP per IPv4 address are injected into the bridge
+// as if they were received from the container port, which moves the bridge's
+// FDB entry for the MAC and floods the announcement to the rest of the network.
+// Entries the bridge learned for the MAC on other ports are flushed first, so
+// that no traffic follows them until the announcement went out.
+func cmdAnnounce(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: rainier announce <containerID> <mac> [ipv4 ...]")
+	}
+	mac, err := net.ParseMAC(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid mac %q: %v", args[1], err)
+	}
+	ips := []net.IP{}
+	for _, arg := range args[2:] {
+		ip := net.ParseIP(arg).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid IPv4 address %q", arg)
+		}
+		ips = append(ips, ip)
+	}
+
+	bridgeName, hostIfName, ofport, err := containerPort(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := flushStaleMAC(bridgeName, ofport, mac); err != nil {
+		return err
+	}
+	packets := [][]byte{arpPacket(etherTypeRARP, rarpRequest, mac, net.IPv4zero.To4())}
+	for _, ip := range ips {
+		packets = append(packets, arpPacket(etherTypeARP, arpRequest, mac, ip))
+	}
+	for _, packet := range packets {
+		_, err := ofctl("packet-out", bridgeName, strconv.Itoa(ofport), "normal", hex.EncodeToString(packet))
+		if err != nil {
+			return fmt.Errorf("Failed to announce %s on port %s. Error = %s", mac, hostIfName, err)
+		}
+	}
+	return nil
+}
+
+// flushStaleMAC deletes the bridge's FDB entries for the MAC on other ports.
+// Older OVS has no fdb/del, the whole FDB of the bridge is flushed then.
+func flushStaleMAC(bridgeName string, ofport int, mac net.HardwareAddr) error {
+	out, err := ovsExec("ovs-appctl", "fdb/show", bridgeName)
+	if err != nil {
+		return fmt.Errorf("Failed to list the FDB of %s. Error = %s", bridgeName, err)
+	}
+	for _, line := range strings.Split(out, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] == strconv.Itoa(ofport) {
+			continue
+		}
+		if learned, err := net.ParseMAC(fields[2]); err != nil || learned.String() != mac.String() {
+			continue
+		}
+		if _, err := ovsExec("ovs-appctl", "fdb/del", bridgeName, fields[1], fields[2]); err != nil {
+			if _, err := ovsExec("ovs-appctl", "fdb/flush", bridgeName); err != nil {
+				return fmt.Errorf("Failed to flush the FDB of %s. Error = %s", bridgeName, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// arpPacket builds a broadcast (R)ARP frame in which the sender and the
+// target are both the announced address, as GARP and RARP expect.
+func arpPacket(etherType uint16, op uint16, mac net.HardwareAddr, ip net.IP) []byte {
+	packet := make([]byte, 0, 42)
+	packet = append(packet, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}...)
+	packet = append(packet, mac...)
+	packet = appendUint16(packet, etherType)
+	packet = appendUint16(packet, 1)      // Ethernet
+	packet = appendUint16(packet, 0x0800) // IPv4
+	packet = append(packet, 6, 4)
+	packet = appendUint16(packet, op)
+	packet = append(packet, mac...)
+	packet = append(packet, ip...)
+	if op == arpRequest {
+		packet = append(packet, make(net.HardwareAddr, 6)...)
+	} else {
+		packet = append(packet, mac...)
+	}
+	return append(packet, ip...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
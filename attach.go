@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// configureAttachment finishes ADD for modes that give the container an
+// interface of its own rather than a port on the bridge: it runs IPAM,
+// configures the interface and prints the result
+func configureAttachment(config *RainierConfig, args *skel.CmdArgs, report *opReport, netns ns.NetNS, pod podArgs, containerInterface *current.Interface) error {
+	// Invoke IPAM
+	if err := report.step("ipamAdd"); err != nil {
+		return err
+	}
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	result, err := execIpamAdd(config, key, args.StdinData)
+	if err != nil {
+		return err
+	}
+	report.ipamAdded()
+	if err := selectIPs(config, result); err != nil {
+		return err
+	}
+	if config.IPv6Only {
+		if err := ipv6OnlyResult(result, config.Slaac != nil); err != nil {
+			return err
+		}
+	}
+	dualStackResult(result)
+	if !isPrimaryNetwork(config) {
+		secondaryResult(result)
+	}
+	setContainerInterface(result, nil, containerInterface)
+
+	// Apply IP address to the container interface
+	if err := report.step("configureInterface"); err != nil {
+		return err
+	}
+	skipIPConfig, err := pod.bool("skipIPConfig", config.SkipIPConfig)
+	if err != nil {
+		return err
+	}
+	if !skipIPConfig {
+		err = netns.Do(func(_ ns.NetNS) error {
+			if config.IPv6Only {
+				if err := configureIPv6Only(config, args.IfName); err != nil {
+					return err
+				}
+			}
+			if err := enableIPv6(args.IfName, result); err != nil {
+				return err
+			}
+			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+				return err
+			}
+			if config.Slaac != nil {
+				if err := waitForSlaac(args.IfName, config.Slaac.Timeout, result); err != nil {
+					return err
+				}
+			}
+			return addExtraAddresses(config.ExtraAddresses, args.IfName, netns.Path(), result)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if isPrimaryNetwork(config) {
+		result.DNS = config.DNS
+	}
+
+	if err := report.step("saveState"); err != nil {
+		return err
+	}
+	if err := recordAddresses(key, result); err != nil {
+		return err
+	}
+	if err := cacheResult(config.Name, args, result); err != nil {
+		return err
+	}
+	return printChainedResult(config, result)
+}
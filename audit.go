@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Three sources of truth describe what rainier attached on a node: its
+// state file, the ports of the OVS bridges and the host veths in the kernel,
+// whose peers live in the containers' namespaces. Crashes, manual changes
+// and runtimes that never ran DEL make them disagree. Ports of other tools
+// are listed too, so that what rainier leaves alone is known.
+
+type discrepancy struct {
+	Interface   string `json:"interface"`
+	ContainerID string `json:"containerID,omitempty"`
+	Problem     string `json:"problem"`
+	Remedy      string `json:"remedy"`
+}
+
+// cmdAudit compares the state file, OVS and the kernel and prints what
+// disagrees, with a command to fix it:
+//
+//	rainier audit [-json]
+func cmdAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	found, err := audit()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(found)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INTERFACE\tCONTAINER\tPROBLEM\tREMEDY")
+	for _, d := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Interface, shortID(d.ContainerID), d.Problem, d.Remedy)
+	}
+	return w.Flush()
+}
+
+func audit() ([]discrepancy, error) {
+	// State file
+	readHostInterfacesFromFile()
+	owners := make(map[string]string)
+	for key, name := range hostInterfaces {
+		if strings.HasPrefix(name.(string), HostVethPrefix) {
+			owners[name.(string)] = keyContainerID(key)
+		}
+	}
+
+	// OVS ports, and the bridge of each
+	out, err := vsctl("--bare", "--columns=name", "list", "interface")
+	if err != nil {
+		return nil, err
+	}
+	ports := make(map[string]string)
+	for _, name := range strings.Fields(out) {
+		if !strings.HasPrefix(name, HostVethPrefix) {
+			continue
+		}
+		bridgeName, _ := vsctl("port-to-br", name)
+		ports[name] = bridgeName
+	}
+
+	// Ports of other tools
+	tools, err := portTools()
+	if err != nil {
+		return nil, err
+	}
+
+	// Kernel veths
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	veths := make(map[string]netlink.Link)
+	for _, link := range links {
+		if link.Type() == "veth" && strings.HasPrefix(link.Attrs().Name, HostVethPrefix) {
+			veths[link.Attrs().Name] = link
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, set := range []map[string]string{owners, ports} {
+		for name := range set {
+			names[name] = true
+		}
+	}
+	for name := range veths {
+		names[name] = true
+	}
+
+	found := []discrepancy{}
+	for name := range names {
+		containerID, recorded := owners[name]
+		bridgeName, isPort := ports[name]
+		link, inKernel := veths[name]
+		d := discrepancy{Interface: name, ContainerID: containerID}
+		switch {
+		case recorded && !inKernel && isPort:
+			d.Problem = "veth is gone but still a port and in the state file"
+			d.Remedy = fmt.Sprintf("ovs-vsctl --if-exists del-port %s %s, then DEL the container", bridgeName, name)
+		case recorded && !inKernel:
+			d.Problem = "veth is gone but still in the state file"
+			d.Remedy = "DEL the container through its runtime"
+		case !recorded && inKernel && isPort:
+			d.Problem = "port of a container rainier has no record of"
+			d.Remedy = fmt.Sprintf("ovs-vsctl del-port %s %s && ip link del %s", bridgeName, name, name)
+		case !recorded && inKernel:
+			d.Problem = "leaked veth, neither recorded nor a port"
+			d.Remedy = "rainier cleanup"
+		case !recorded && isPort:
+			d.Problem = "port without a veth"
+			d.Remedy = fmt.Sprintf("ovs-vsctl del-port %s %s", bridgeName, name)
+		case !isPort:
+			d.Problem = "veth of an attached container is not a port"
+			d.Remedy = "run CHECK with selfHeal, or DEL and ADD the container"
+		case peerInHostNamespace(link):
+			d.Problem = "container end of the veth is not in a namespace"
+			d.Remedy = "DEL the container through its runtime"
+		default:
+			continue
+		}
+		found = append(found, d)
+	}
+	for name, tool := range tools {
+		bridgeName, err := vsctl("port-to-br", name)
+		if err != nil {
+			continue
+		}
+		found = append(found, discrepancy{
+			Interface: name,
+			Problem:   fmt.Sprintf("port of %s on bridge %s, left alone by GC and cleanup", tool, bridgeName),
+			Remedy:    "rainier migrate, if rainier is to own it",
+		})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Interface < found[j].Interface })
+	return found, nil
+}
+
+// peerInHostNamespace tells whether the other end of a veth is in the host's
+// namespace rather than a container's
+func peerInHostNamespace(link netlink.Link) bool {
+	peer, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+	return err == nil && peer.Type() == "veth" && peer.Attrs().ParentIndex == link.Attrs().Index
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const DefaultBackend = "ovs-exec"
+
+// Backend programs the datapath: the bridge, container ports and their
+// flows. ADD, DEL and CHECK go through it so that another datapath, such as
+// an OVSDB client or OVN, can be added by registering a Backend. Features
+// that only exist in OVS, like tunnels, mirrors or QoS, still talk to OVS
+// directly.
+type Backend interface {
+	EnsureBridge(bridgeName string) error
+	AddPort(bridgeName string, portName string) error
+	DeletePort(bridgeName string, portName string) error
+	AddFlows(bridgeName string, flows ...string) error
+	DeletePortFlows(bridgeName string, ofport int) error
+}
+
+// backends are the datapaths compiled in, by the name the backend setting
+// selects them with
+var backends = map[string]func() Backend{
+	DefaultBackend: func() Backend { return ovsExecBackend{} },
+}
+
+var dataplane Backend = ovsExecBackend{}
+
+func selectBackend(name string) error {
+	if name == "" {
+		name = DefaultBackend
+	}
+	newBackend, ok := backends[name]
+	if !ok {
+		return fmt.Errorf("unknown backend %q, expected one of: %s", name, strings.Join(backendNames(), ", "))
+	}
+	dataplane = newBackend()
+	return nil
+}
+
+func backendNames() []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ovsExecBackend runs ovs-vsctl and ovs-ofctl for every change
+type ovsExecBackend struct{}
+
+func (ovsExecBackend) EnsureBridge(bridgeName string) error {
+	return createOvsBr(bridgeName)
+}
+
+func (ovsExecBackend) AddPort(bridgeName string, portName string) error {
+	return addOvsPort(bridgeName, portName)
+}
+
+func (ovsExecBackend) DeletePort(bridgeName string, portName string) error {
+	return deleteOvsPort(bridgeName, portName)
+}
+
+func (ovsExecBackend) AddFlows(bridgeName string, flows ...string) error {
+	return addFlows(bridgeName, flows...)
+}
+
+func (ovsExecBackend) DeletePortFlows(bridgeName string, ofport int) error {
+	return deletePortFlows(bridgeName, ofport)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Runtimes pass a pod's bandwidth limits through the "bandwidth" capability,
+// in bits per second and bits like the bandwidth plugin takes them. Traffic
+// to the pod leaves the bridge through its port and is shaped there by an
+// HTB QoS of its own; traffic from the pod enters the bridge through the port
+// and is policed with the port's ingress policing, which OVS takes in kbps
+// and kb. A guaranteed rate, which QoS profiles may set, is the queue's
+// min-rate. QoS and queue records are not garbage collected by ovsdb, so DEL
+// destroys them.
+type Bandwidth struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+func validateBandwidth(bw *Bandwidth) error {
+	if bw == nil {
+		return nil
+	}
+	if bw.IngressBurst > 0 && bw.IngressRate == 0 {
+		return fmt.Errorf("bandwidth ingressBurst needs an ingressRate")
+	}
+	if bw.EgressBurst > 0 && bw.EgressRate == 0 {
+		return fmt.Errorf("bandwidth egressBurst needs an egressRate")
+	}
+	if bw.EgressRate > 0 && bw.EgressRate < 1000 {
+		return fmt.Errorf("bandwidth egressRate must be at least 1000 bits per second")
+	}
+	return nil
+}
+
+func setPortBandwidth(hostIfName string, bw *Bandwidth, minRate uint64) error {
+	policing := []string{"set", "interface", hostIfName,
+		"ingress_policing_rate=" + strconv.FormatUint(bw.EgressRate/1000, 10),
+		"ingress_policing_burst=" + strconv.FormatUint(bw.EgressBurst/1000, 10)}
+	if _, err := vsctl(policing...); err != nil {
+		return fmt.Errorf("Failed to police port %s. Error = %s", hostIfName, err)
+	}
+	if bw.IngressRate == 0 {
+		return clearPortBandwidth(hostIfName)
+	}
+
+	maxRate := "other-config:max-rate=" + strconv.FormatUint(bw.IngressRate, 10)
+	burst := "other-config:burst=" + strconv.FormatUint(bw.IngressBurst, 10)
+	queueConfig := []string{maxRate, burst}
+	if minRate > 0 {
+		queueConfig = append(queueConfig, "other-config:min-rate="+strconv.FormatUint(minRate, 10))
+	}
+	qos, err := vsctl("--bare", "--columns=_uuid", "find", "qos", "external_ids:rainier-qos=port-"+hostIfName)
+	if err != nil {
+		return err
+	}
+	// Converge the existing QoS instead of piling up new records on every ADD
+	if qos == "" {
+		args := []string{"set", "port", hostIfName, "qos=@qos",
+			"--", "--id=@qos", "create", "qos", "type=linux-htb", maxRate,
+			"external_ids:rainier-qos=port-" + hostIfName, "queues:0=@queue",
+			"--", "--id=@queue", "create", "queue"}
+		_, err = vsctl(append(args, queueConfig...)...)
+	} else {
+		var queue string
+		queue, err = vsctl("get", "qos", qos, "queues:0")
+		if err == nil {
+			args := []string{"set", "port", hostIfName, "qos=" + qos,
+				"--", "set", "qos", qos, maxRate,
+				"--", "remove", "queue", queue, "other_config", "min-rate",
+				"--", "set", "queue", queue}
+			_, err = vsctl(append(args, queueConfig...)...)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to shape port %s. Error = %s", hostIfName, err)
+	}
+	return nil
+}
+
+// clearPortBandwidth removes the port's QoS and destroys its records
+func clearPortBandwidth(hostIfName string) error {
+	out, err := vsctl("--bare", "--columns=_uuid", "find", "qos", "external_ids:rainier-qos=port-"+hostIfName)
+	if err != nil {
+		return err
+	}
+	for _, qos := range strings.Fields(out) {
+		queues, err := vsctl("get", "qos", qos, "queues")
+		if err != nil {
+			return err
+		}
+		args := []string{"--if-exists", "clear", "port", hostIfName, "qos", "--", "destroy", "qos", qos}
+		for _, field := range strings.FieldsFunc(queues, func(r rune) bool { return strings.ContainsRune("{}=, ", r) }) {
+			// queues reads as {0=<uuid>}
+			if len(field) == 36 {
+				args = append(args, "--", "destroy", "queue", field)
+			}
+		}
+		if _, err := vsctl(args...); err != nil {
+			return fmt.Errorf("Failed to remove QoS of port %s. Error = %s", hostIfName, err)
+		}
+	}
+	return nil
+}
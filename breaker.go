@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const BreakerJson = StateDir + "/ovs-breaker.json"
+
+// ErrTryAgainLater is the CNI error code telling the runtime to retry later
+const ErrTryAgainLater uint = 11
+
+// CircuitBreaker stops rainier from exec'ing OVS commands once they failed
+// Failures times within Window seconds, for Cooldown seconds. A wedged
+// ovs-vswitchd then gets retryable errors instead of a pile of hung sudo
+// processes. Every plugin invocation is a new process, so the breaker's
+// state is kept on disk.
+type CircuitBreaker struct {
+	Failures int `json:"failures"`
+	Window   int `json:"window"`
+	Cooldown int `json:"cooldown"`
+}
+
+type breakerState struct {
+	Failures  []int64 `json:"failures"`
+	OpenUntil int64   `json:"openUntil"`
+}
+
+var ovsBreaker *CircuitBreaker
+
+func validateCircuitBreaker(cb *CircuitBreaker) error {
+	if cb == nil {
+		return nil
+	}
+	if cb.Failures <= 0 || cb.Window <= 0 || cb.Cooldown <= 0 {
+		return fmt.Errorf("ovsCircuitBreaker needs positive failures, window and cooldown")
+	}
+	return nil
+}
+
+func breakerOpen() error {
+	if ovsBreaker == nil {
+		return nil
+	}
+	state := readBreakerState()
+	if time.Now().Unix() < state.OpenUntil {
+		return &types.Error{
+			Code:    ErrTryAgainLater,
+			Msg:     "OVS operations are failing repeatedly, try again later",
+			Details: fmt.Sprintf("circuit breaker open until %s", time.Unix(state.OpenUntil, 0).Format(time.RFC3339)),
+		}
+	}
+	return nil
+}
+
+// breakerRecord counts failures that point at an unhealthy OVS rather than
+// at a bad request, such as a missing port
+func breakerRecord(err error, out []byte) {
+	if ovsBreaker == nil || err == nil {
+		return
+	}
+	if _, ok := err.(*exec.ExitError); ok && !ovsUnhealthy(string(out)) {
+		return
+	}
+
+	now := time.Now().Unix()
+	state := &breakerState{}
+	err = updateState(BreakerJson, state, func() error {
+		failures := []int64{now}
+		for _, failure := range state.Failures {
+			if now-failure < int64(ovsBreaker.Window) {
+				failures = append(failures, failure)
+			}
+		}
+		state.Failures = failures
+		if len(failures) >= ovsBreaker.Failures {
+			state.Failures = nil
+			state.OpenUntil = now + int64(ovsBreaker.Cooldown)
+			fmt.Fprintf(os.Stderr, "rainier: %d OVS failures within %ds, pausing OVS operations for %ds\n",
+				len(failures), ovsBreaker.Window, ovsBreaker.Cooldown)
+		}
+		return nil
+	})
+	// The failure itself is what the caller reports; a breaker that cannot
+	// count it only has to say so
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rainier: failed to record OVS failure in %s: %v\n", BreakerJson, err)
+	}
+}
+
+func ovsUnhealthy(out string) bool {
+	for _, symptom := range []string{"database connection failed", "Connection refused", "timed out", "Alarm clock"} {
+		if strings.Contains(out, symptom) {
+			return true
+		}
+	}
+	return false
+}
+
+func readBreakerState() *breakerState {
+	state := &breakerState{}
+	readState(BreakerJson, state)
+	return state
+}
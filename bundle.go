@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultConfPath = "/etc/cni/net.d/rainier.conf"
+const maxBundledReports = 100
+
+var secretPattern = regexp.MustCompile(`(?i)("?[\w.-]*(?:password|passwd|token|secret|credential|private[_-]?key)[\w.-]*"?\s*[:=]\s*)("[^"]*"|[^\s,}]+)`)
+
+// cmdSupportBundle gathers what is needed to debug a node into a tarball
+// that users can attach to bug reports:
+//
+//	rainier support-bundle [-conf rainier.conf] [-output bundle.tar.gz]
+func cmdSupportBundle(args []string) error {
+	flags := flag.NewFlagSet("support-bundle", flag.ContinueOnError)
+	confPath := flags.String("conf", DefaultConfPath, "rainier network configuration")
+	output := flags.String("output", "", "bundle to write, rainier-support-<time>.tar.gz by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format("20060102T150405")
+	if *output == "" {
+		*output = fmt.Sprintf("rainier-support-%s.tar.gz", now)
+	}
+	bundle, err := newBundle(*output, "rainier-support-"+now)
+	if err != nil {
+		return err
+	}
+
+	// Configuration and state
+	config := &RainierConfig{}
+	if jsonByte, err := ioutil.ReadFile(*confPath); err != nil {
+		bundle.addText("config/error.txt", err.Error())
+	} else {
+		bundle.addText("config/"+filepath.Base(*confPath), string(jsonByte))
+		json.Unmarshal(jsonByte, config)
+	}
+	for _, path := range []string{HostInterfaceJson, HostDeviceJson, SegmentJson, BreakerJson, AddressJson, ModeJson, PodArgsJson, MaintenanceFile} {
+		bundle.addFile("state/"+filepath.Base(path), path)
+	}
+	results, _ := filepath.Glob(filepath.Join(ResultCacheDir, "*", "*", "*"))
+	for _, path := range results {
+		rel, _ := filepath.Rel(StateDir, path)
+		bundle.addFile("state/"+rel, path)
+	}
+
+	// OVS, limited to the flows rainier owns
+	bundle.addCommand("ovs/show.txt", true, "ovs-vsctl", "show")
+	bridges := []string{}
+	if out, err := runOvs("ovs-vsctl", "list-br"); err == nil {
+		bridges = strings.Fields(string(out))
+	}
+	cookie := fmt.Sprintf("cookie=%#x/%#x", flowCookie(0, 0), cookieMagicMask)
+	for _, bridge := range bridges {
+		bundle.addCommand("ovs/flows-"+bridge+".txt", true, "ovs-ofctl", "-O", strings.Join(ovsProtocols, ","), "dump-flows", bridge, cookie)
+		bundle.addCommand("ovs/ports-"+bridge+".txt", true, "ovs-ofctl", "-O", strings.Join(ovsProtocols, ","), "dump-ports-desc", bridge)
+	}
+
+	// Host interfaces
+	bundle.addCommand("net/links.txt", false, "ip", "-d", "link", "show")
+	bundle.addCommand("net/addresses.txt", false, "ip", "address", "show")
+	bundle.addCommand("net/routes.txt", false, "ip", "route", "show", "table", "all")
+
+	// Most recent operation reports, which are rainier's logs
+	if config.ReportDir != "" {
+		reports, _ := filepath.Glob(filepath.Join(config.ReportDir, "*.json"))
+		sort.Strings(reports)
+		if len(reports) > maxBundledReports {
+			reports = reports[len(reports)-maxBundledReports:]
+		}
+		for _, report := range reports {
+			bundle.addFile("reports/"+filepath.Base(report), report)
+		}
+	}
+
+	if err := bundle.close(); err != nil {
+		return err
+	}
+	fmt.Println(*output)
+	return nil
+}
+
+type supportBundle struct {
+	file *os.File
+	gz   *gzip.Writer
+	tar  *tar.Writer
+	root string
+	err  error
+}
+
+func newBundle(path string, root string) (*supportBundle, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	return &supportBundle{file: file, gz: gz, tar: tar.NewWriter(gz), root: root}, nil
+}
+
+// addText scrubs secrets from the content before adding it
+func (b *supportBundle) addText(name string, content string) {
+	if b.err != nil {
+		return
+	}
+	data := []byte(secretPattern.ReplaceAllString(content, `${1}"<redacted>"`))
+	header := &tar.Header{
+		Name:    b.root + "/" + name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if b.err = b.tar.WriteHeader(header); b.err == nil {
+		_, b.err = b.tar.Write(data)
+	}
+}
+
+func (b *supportBundle) addFile(name string, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		b.addText(name+".error", err.Error())
+		return
+	}
+	b.addText(name, string(data))
+}
+
+func (b *supportBundle) addCommand(name string, ovs bool, cmd string, args ...string) {
+	var out []byte
+	var err error
+	if ovs {
+		out, err = runOvs(cmd, args...)
+	} else {
+		out, err = exec.Command(cmd, args...).CombinedOutput()
+	}
+	content := fmt.Sprintf("$ %s %s\n%s", cmd, strings.Join(args, " "), out)
+	if err != nil {
+		content += fmt.Sprintf("\nerror: %v\n", err)
+	}
+	b.addText(name, content)
+}
+
+func (b *supportBundle) close() error {
+	for _, closer := range []func() error{b.tar.Close, b.gz.Close, b.file.Close} {
+		if err := closer(); err != nil && b.err == nil {
+			b.err = err
+		}
+	}
+	return b.err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const DefaultCNIPath = "/opt/cni/bin"
+
+// cmdCanary attaches a throwaway network namespace with a new configuration,
+// the way the container runtime would, pings through it and detaches it
+// again. Only when that works is the configuration copied into place, so a
+// bad push fails on one node instead of breaking every new pod:
+//
+//	rainier canary -conf new.conf [-target ip] [-activate rainier.conf]
+func cmdCanary(args []string) error {
+	flags := flag.NewFlagSet("canary", flag.ContinueOnError)
+	confPath := flags.String("conf", "", "configuration to try")
+	target := flags.String("target", "", "address to ping from the canary, its gateway by default")
+	activate := flags.String("activate", "", "where to install the configuration once the canary passed")
+	cniPath := flags.String("cni-path", DefaultCNIPath, "directory of the CNI plugins, IPAM included")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *confPath == "" {
+		return fmt.Errorf("usage: rainier canary -conf new.conf [-target ip] [-activate rainier.conf]")
+	}
+	if _, err := loadConfigFile(*confPath); err != nil {
+		return err
+	}
+	conf, err := ioutil.ReadFile(*confPath)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("rainier-canary-%d", os.Getpid())
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create namespace %s: %v: %s", name, err, out)
+	}
+	defer exec.Command("ip", "netns", "delete", name).Run()
+
+	canary := canaryAttachment{
+		conf:        conf,
+		cniPath:     *cniPath,
+		containerID: name,
+		netns:       filepath.Join("/var/run/netns", name),
+	}
+	// A failed ADD may still have left addresses or a port behind, DEL
+	// releases them as the runtime's would
+	out, err := canary.run("ADD")
+	if err != nil {
+		if _, delErr := canary.run("DEL"); delErr != nil {
+			return fmt.Errorf("canary ADD failed: %v, and DEL after it: %v", err, delErr)
+		}
+		return fmt.Errorf("canary ADD failed: %v", err)
+	}
+	result := &current.Result{}
+	if err := json.Unmarshal(out, result); err != nil {
+		canary.run("DEL")
+		return fmt.Errorf("canary ADD returned an invalid result: %v", err)
+	}
+	if *target == "" {
+		for _, ipc := range result.IPs {
+			if ipc.Gateway != nil {
+				*target = ipc.Gateway.String()
+				break
+			}
+		}
+	}
+	if *target != "" {
+		ping := "ping"
+		if strings.Contains(*target, ":") {
+			ping = "ping6"
+		}
+		if out, err := exec.Command("ip", "netns", "exec", name, ping, "-c", "3", "-W", "1", *target).CombinedOutput(); err != nil {
+			canary.run("DEL")
+			return fmt.Errorf("canary cannot reach %s: %v: %s", *target, err, out)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "rainier: no gateway to ping, only ADD and DEL were tried")
+	}
+	if _, err := canary.run("DEL"); err != nil {
+		return fmt.Errorf("canary DEL failed: %v", err)
+	}
+
+	if *activate == "" {
+		return nil
+	}
+	// Rename, so the runtime never reads a half written configuration
+	staging := *activate + ".rainier-canary"
+	if err := ioutil.WriteFile(staging, conf, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", staging, err)
+	}
+	if err := os.Rename(staging, *activate); err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("failed to install %s: %v", *activate, err)
+	}
+	return nil
+}
+
+type canaryAttachment struct {
+	conf        []byte
+	cniPath     string
+	containerID string
+	netns       string
+}
+
+// run invokes this binary as the container runtime would
+func (c canaryAttachment) run(command string) ([]byte, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+c.containerID,
+		"CNI_NETNS="+c.netns,
+		"CNI_IFNAME=eth0",
+		"CNI_PATH="+c.cniPath,
+	)
+	cmd.Stdin = bytes.NewReader(c.conf)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s%s", err, out, stderr)
+	}
+	return out, nil
+}
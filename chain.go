@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// In a conflist rainier may follow other plugins, whose result arrives as
+// prevResult, and be followed by plugins such as portmap, bandwidth or
+// firewall, which take rainier's result as theirs. The result therefore
+// reports the host end of the veth next to the container interface, which
+// bandwidth looks for, and carries on what earlier plugins reported, with
+// rainier's interfaces, addresses and routes after theirs.
+
+// setContainerInterface reports the host and container interfaces and
+// points the addresses IPAM returned at the container interface by its
+// index in the result. Modes without a host interface pass nil.
+func setContainerInterface(result *current.Result, host *current.Interface, container *current.Interface) {
+	result.Interfaces = []*current.Interface{container}
+	if host != nil {
+		result.Interfaces = []*current.Interface{host, container}
+	}
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(containerIndex(result, container.Name))
+	}
+}
+
+// containerIndex returns the index of the named container interface in the
+// result's interfaces, 0 when the result has none yet
+func containerIndex(result *current.Result, ifName string) int {
+	for i, iface := range result.Interfaces {
+		if iface.Name == ifName && iface.Sandbox != "" {
+			return i
+		}
+	}
+	return 0
+}
+
+// chainResult appends rainier's result to the one of earlier plugins in the
+// chain. DNS settings of rainier win when it has any.
+func chainResult(prev *current.Result, result *current.Result) *current.Result {
+	chained := *prev
+	chained.CNIVersion = result.CNIVersion
+	offset := len(prev.Interfaces)
+	chained.Interfaces = append(append([]*current.Interface{}, prev.Interfaces...), result.Interfaces...)
+	chained.IPs = append([]*current.IPConfig{}, prev.IPs...)
+	for _, ipc := range result.IPs {
+		shifted := *ipc
+		if ipc.Interface != nil {
+			shifted.Interface = current.Int(*ipc.Interface + offset)
+		}
+		chained.IPs = append(chained.IPs, &shifted)
+	}
+	chained.Routes = append(append([]*types.Route{}, prev.Routes...), result.Routes...)
+	if len(result.DNS.Nameservers) > 0 || result.DNS.Domain != "" || len(result.DNS.Search) > 0 || len(result.DNS.Options) > 0 {
+		chained.DNS = result.DNS
+	}
+	return &chained
+}
+
+// containerResult narrows a chained prevResult to the addresses of the
+// container interface, which CHECK verifies; addresses of other
+// interfaces, such as extraAddresses on lo or those of earlier plugins, are
+// left out.
+func containerResult(result *current.Result, ifName string) *current.Result {
+	own := *result
+	own.IPs = []*current.IPConfig{}
+	for _, ipc := range result.IPs {
+		if ipc.Interface == nil || *ipc.Interface < 0 || *ipc.Interface >= len(result.Interfaces) {
+			own.IPs = append(own.IPs, ipc)
+			continue
+		}
+		iface := result.Interfaces[*ipc.Interface]
+		if iface.Name == ifName && iface.Sandbox != "" {
+			own.IPs = append(own.IPs, ipc)
+		}
+	}
+	return &own
+}
+
+// printChainedResult prints the result of ADD, behind the one of earlier
+// plugins when rainier runs mid-chain
+func printChainedResult(config *RainierConfig, result *current.Result) error {
+	if config.RawPrevResult != nil {
+		prev, err := parsePrevResult(config)
+		if err != nil {
+			return err
+		}
+		result = chainResult(prev, result)
+	}
+	return types.PrintResult(result, config.NetConf.CNIVersion)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const neighborProbeTimeout = time.Second
+
+// ErrCheckFailed is the CNI error code of a CHECK that found problems. Codes
+// from 100 up are left to plugins.
+const ErrCheckFailed uint = 100
+
+func parsePrevResult(config *RainierConfig) (*current.Result, error) {
+	if config.RawPrevResult == nil {
+		return nil, fmt.Errorf("prevResult is required")
+	}
+	jsonByte, err := json.Marshal(config.RawPrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to encode prevResult")
+	}
+	r, err := version.NewResult(config.CNIVersion, jsonByte)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to decode prevResult: %v", err)
+	}
+	return current.NewResultFromResult(r)
+}
+
+func ipFamily(version string) int {
+	if version == "6" {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// checkContainerRoutes verifies, for every address family the container got
+// addresses in, that a default route exists and that the gateways answer
+// neighbor resolution. Secondary networks leave the default routes to the
+// primary one. Every mismatch is reported, not just the first one.
+func checkContainerRoutes(ifName string, result *current.Result, primary bool) []string {
+	problems := []string{}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return append(problems, fmt.Sprintf("interface %s not found in container", ifName))
+	}
+
+	checked := make(map[string]bool)
+	for _, ipc := range result.IPs {
+		if !primary || checked[ipVersion(ipc.Address.IP)] {
+			continue
+		}
+		checked[ipVersion(ipc.Address.IP)] = true
+		routes, err := netlink.RouteList(link, ipFamily(ipVersion(ipc.Address.IP)))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to list IPv%s routes: %v", ipVersion(ipc.Address.IP), err))
+			continue
+		}
+		hasDefault := false
+		for _, route := range routes {
+			if route.Dst == nil || route.Dst.IP.IsUnspecified() {
+				hasDefault = true
+			}
+		}
+		if !hasDefault {
+			problems = append(problems, fmt.Sprintf("no IPv%s default route on %s", ipVersion(ipc.Address.IP), ifName))
+		}
+	}
+
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil {
+			continue
+		}
+		if !neighborReachable(link, ipc.Gateway, ipFamily(ipVersion(ipc.Address.IP))) {
+			problems = append(problems, fmt.Sprintf("gateway %s is not reachable from %s", ipc.Gateway, ifName))
+		}
+	}
+	return problems
+}
+
+func neighborReachable(link netlink.Link, gateway net.IP, family int) bool {
+	deadline := time.Now().Add(neighborProbeTimeout)
+	probed := false
+	for {
+		neighs, err := netlink.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			return false
+		}
+		for _, neigh := range neighs {
+			if !neigh.IP.Equal(gateway) {
+				continue
+			}
+			switch neigh.State {
+			case netlink.NUD_REACHABLE, netlink.NUD_STALE, netlink.NUD_DELAY, netlink.NUD_PERMANENT:
+				return true
+			}
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		// Send a datagram towards the gateway to make the kernel resolve it
+		if !probed {
+			if conn, err := net.Dial("udp", net.JoinHostPort(gateway.String(), "9")); err == nil {
+				conn.Write([]byte{0})
+				conn.Close()
+			}
+			probed = true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// checkContainerAddresses verifies every address of prevResult is still on
+// the container interface
+func checkContainerAddresses(ifName string, result *current.Result) []string {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		// Reported by checkContainerRoutes
+		return nil
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list addresses of %s: %v", ifName, err)}
+	}
+	problems := []string{}
+	for _, ipc := range result.IPs {
+		found := false
+		for _, addr := range addrs {
+			found = found || addr.IP.Equal(ipc.Address.IP)
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("address %s is missing from %s", ipc.Address.IP, ifName))
+		}
+	}
+	return problems
+}
+
+func checkVethMTU(netns ns.NetNS, ifName string, hostIfName string) []string {
+	hostLink, err := netlink.LinkByName(hostIfName)
+	if err != nil {
+		return []string{fmt.Sprintf("host interface %s not found", hostIfName)}
+	}
+	containerMTU := 0
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		containerMTU = link.Attrs().MTU
+		return nil
+	})
+	if err != nil {
+		return []string{fmt.Sprintf("interface %s not found in container", ifName)}
+	}
+	if containerMTU != hostLink.Attrs().MTU {
+		return []string{fmt.Sprintf("MTU mismatch: %s has %d, %s has %d", ifName, containerMTU, hostIfName, hostLink.Attrs().MTU)}
+	}
+	return nil
+}
+
+// checkProblems reports everything CHECK found as one CNI error
+func checkProblems(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &types.Error{
+		Code:    ErrCheckFailed,
+		Msg:     "check failed",
+		Details: strings.Join(problems, "; "),
+	}
+}
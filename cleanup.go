@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const HostVethPrefix = "rvh"
+const PortsLock = StateDir + "/ports.lock"
+
+// Host veths are named after the attachment they belong to, so that a
+// retried ADD finds the leftovers of a failed one and leaks can be told
+// apart from interfaces rainier does not own. Attachment keys of any length
+// hash to a name that fits IFNAMSIZ. When the hash collides with the veth
+// of another attachment, the key is hashed again with a counter, which a
+// retry of the same ADD repeats and so lands on the same name. The name is
+// recorded as the attachment's under the same lock as the collision scan,
+// so that concurrent ADDs cannot pick the same one.
+const MaxHostVethCollisions = 8
+
+func reserveHostVeth(key string) (string, error) {
+	reserved := ""
+	err := updateState(HostInterfaceJson, &hostInterfaces, func() error {
+		owners := make(map[string]string)
+		for owner, name := range hostInterfaces {
+			owners[name.(string)] = owner
+		}
+		for i := 0; i < MaxHostVethCollisions; i++ {
+			salted := key
+			if i > 0 {
+				salted = fmt.Sprintf("%s#%d", key, i)
+			}
+			name := fmt.Sprintf("%s%08x", HostVethPrefix, crc32.ChecksumIEEE([]byte(salted)))
+			if owner, ok := owners[name]; !ok || owner == key {
+				hostInterfaces[key] = name
+				reserved = name
+				return nil
+			}
+		}
+		return fmt.Errorf("no free host veth name for %s", key)
+	})
+	return reserved, err
+}
+
+// ADD holds PortsLock shared from allocating the segment until it is
+// done; cleanup holds it exclusively, so it never sees a veth that is still
+// being set up.
+func lockPorts(how int) (func(), error) {
+	f, err := lockFile(PortsLock, how)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock %s. Error = %s", PortsLock, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// cmdCleanup deletes rainier's host veths that neither belong to an attached
+// container nor are OVS ports, such as the ones left behind by a plugin that
+// crashed before it added the port to the bridge, and the VLAN ports only
+// such containers used:
+//
+//	rainier cleanup [-dry-run]
+func cmdCleanup(args []string) error {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the veths that would be deleted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	unlock, err := lockPorts(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	leaked, err := leakedVeths()
+	if err != nil {
+		return err
+	}
+	for _, link := range leaked {
+		name := link.Attrs().Name
+		fmt.Println(name)
+		if *dryRun {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", name, err)
+		}
+	}
+	if *dryRun {
+		return nil
+	}
+	return releaseOrphanVlanPorts()
+}
+
+// leakedVeths returns rainier's host veths that neither belong to an
+// attached container nor are OVS ports. PortsLock must be held exclusively.
+func leakedVeths() ([]netlink.Link, error) {
+	inUse := make(map[string]bool)
+	readHostInterfacesFromFile()
+	for _, name := range hostInterfaces {
+		inUse[name.(string)] = true
+	}
+	out, err := vsctl("--bare", "--columns=name", "list", "interface")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Fields(out) {
+		inUse[name] = true
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	leaked := []netlink.Link{}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() == "veth" && strings.HasPrefix(name, HostVethPrefix) && !inUse[name] {
+			leaked = append(leaked, link)
+		}
+	}
+	return leaked, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Subcommands are run when rainier is invoked by an operator rather than by
+// the container runtime, which always sets CNI_COMMAND.
+var subcommands = map[string]func(args []string) error{
+	"announce":       cmdAnnounce,
+	"audit":          cmdAudit,
+	"canary":         cmdCanary,
+	"cleanup":        cmdCleanup,
+	"domains":        cmdDomains,
+	"drops":          cmdDrops,
+	"identities":     cmdIdentities,
+	"maintenance":    cmdMaintenance,
+	"migrate":        cmdMigrate,
+	"quarantine":     cmdQuarantine,
+	"reseed":         cmdReseed,
+	"support-bundle": cmdSupportBundle,
+	"trace":          cmdTrace,
+	"validate":       cmdValidate,
+	"version":        cmdVersion,
+}
+
+func isSubcommand() bool {
+	return len(os.Args) > 1 && os.Getenv("CNI_COMMAND") == ""
+}
+
+func runSubcommand(name string, args []string) error {
+	cmd, ok := subcommands[name]
+	if !ok {
+		names := []string{}
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
+
+// containerAttachment returns the key of the attachment a command names,
+// by container ID when the container has a single attachment or by its
+// network/containerID/ifName key
+func containerAttachment(name string) (string, error) {
+	readHostInterfacesFromFile()
+	if _, ok := hostInterfaces[name]; ok {
+		return name, nil
+	}
+	keys := []string{}
+	for key := range hostInterfaces {
+		if keyContainerID(key) == name {
+			keys = append(keys, key)
+		}
+	}
+	switch len(keys) {
+	case 0:
+		return "", fmt.Errorf("container %s is not attached to rainier", name)
+	case 1:
+		return keys[0], nil
+	}
+	sort.Strings(keys)
+	return "", fmt.Errorf("container %s has several attachments, name one of %s", name, strings.Join(keys, ", "))
+}
+
+// containerPort finds the bridge and OpenFlow port of an attachment's veth
+func containerPort(name string) (string, string, int, error) {
+	key, err := containerAttachment(name)
+	if err != nil {
+		return "", "", 0, err
+	}
+	hostIfName := hostInterfaces[key].(string)
+
+	client := ovsClient()
+	bridgeName, err := client.VSwitch.PortToBridge(hostIfName)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Failed to find bridge of port %s. Error = %s", hostIfName, err)
+	}
+	ofport, err := getOfport(hostIfName)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return bridgeName, hostIfName, ofport, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// rainier may share a bridge with ports of other OVS tooling, e.g. while a
+// node is being moved over to it. Those ports carry their tool's
+// external_ids and no rainier identity. GC and rollback leave them alone even
+// when a name in rainier's state now belongs to one of them, cleanup only
+// ever deletes rainier's veths that are not ports at all, and audit lists
+// them.
+
+// foreignMarkers are external_ids keys other tools set on the ports or
+// interfaces they create. OVN's iface-id is only foreign without rainier's
+// identity next to it.
+var foreignMarkers = []struct {
+	key  string
+	tool string
+}{
+	{"container_id", "ovs-docker"},
+	{"contNetns", "ovs-cni"},
+	{"iface-id", "OVN"},
+}
+
+// portTools returns the tool of every port or interface that carries the
+// external_ids of another tool and none of rainier's, by name
+func portTools() (map[string]string, error) {
+	merged := make(map[string]map[string]string)
+	for _, table := range []string{"port", "interface"} {
+		ids, err := externalIDs(table)
+		if err != nil {
+			return nil, err
+		}
+		for name, keys := range ids {
+			if merged[name] == nil {
+				merged[name] = make(map[string]string)
+			}
+			for key, value := range keys {
+				merged[name][key] = value
+			}
+		}
+	}
+
+	tools := make(map[string]string)
+	for name, keys := range merged {
+		if hasRainierKey(keys) {
+			continue
+		}
+		for _, marker := range foreignMarkers {
+			if _, ok := keys[marker.key]; ok {
+				tools[name] = marker.tool
+				break
+			}
+		}
+	}
+	return tools, nil
+}
+
+func hasRainierKey(keys map[string]string) bool {
+	for key := range keys {
+		if strings.HasPrefix(key, "rainier-") {
+			return true
+		}
+	}
+	return false
+}
+
+// externalIDs returns the external_ids of every record of a table, by name
+func externalIDs(table string) (map[string]map[string]string, error) {
+	out, err := vsctl("--format=json", "--columns=name,external_ids", "list", table)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list %s external_ids. Error = %s", table, err)
+	}
+	// Rows are [name, ["map", [[key, value], ...]]]
+	listing := struct {
+		Data [][]json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &listing); err != nil {
+		return nil, fmt.Errorf("Fail to decode %s external_ids: %v", table, err)
+	}
+	ids := make(map[string]map[string]string)
+	for _, row := range listing.Data {
+		if len(row) != 2 {
+			continue
+		}
+		var name string
+		var column []json.RawMessage
+		if json.Unmarshal(row[0], &name) != nil || json.Unmarshal(row[1], &column) != nil || len(column) != 2 {
+			continue
+		}
+		var pairs [][]string
+		if json.Unmarshal(column[1], &pairs) != nil {
+			continue
+		}
+		ids[name] = make(map[string]string)
+		for _, pair := range pairs {
+			if len(pair) == 2 {
+				ids[name][pair[0]] = pair[1]
+			}
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// DeadlineRollbackShare is the share of the deadline, one in so many, kept
+// for rolling back an ADD that ran out of time
+const DeadlineRollbackShare = 4
+
+// The runtime gives up on a CNI call after its own timeout, and an ADD still
+// running by then leaves a half-attached container behind. With a deadline
+// the steps of an operation have to be done by stepsDeadline: every step
+// starts only before it, and OVS commands and metadata hooks are killed at
+// it rather than after their own timeouts. An ADD that misses it is rolled
+// back in the time left until operationDeadline.
+var stepsDeadline time.Time
+var operationDeadline time.Time
+
+func startDeadline(seconds int) {
+	if seconds == 0 {
+		return
+	}
+	budget := time.Duration(seconds) * time.Second
+	now := time.Now()
+	stepsDeadline = now.Add(budget - budget/DeadlineRollbackShare)
+	operationDeadline = now.Add(budget)
+}
+
+func deadlineExceeded() bool {
+	return !stepsDeadline.IsZero() && !time.Now().Before(stepsDeadline)
+}
+
+// checkDeadline fails the operation when a step would start too late
+func checkDeadline(step string) error {
+	if !deadlineExceeded() {
+		return nil
+	}
+	return &types.Error{
+		Code:    ErrTryAgainLater,
+		Msg:     fmt.Sprintf("deadline exceeded before step %s", step),
+		Details: fmt.Sprintf("steps had to be done by %s", stepsDeadline.Format(time.RFC3339)),
+	}
+}
+
+// withinDeadline shortens a timeout to the time left for the steps
+func withinDeadline(timeout time.Duration) time.Duration {
+	if stepsDeadline.IsZero() {
+		return timeout
+	}
+	if left := time.Until(stepsDeadline); left < timeout {
+		return left
+	}
+	return timeout
+}
+
+// extendDeadline gives what is left of the operation's deadline to its
+// rollback
+func extendDeadline() {
+	stepsDeadline = operationDeadline
+}
@@ -0,0 +1,17 @@
+package main
+
+// With dhcpGuard, pods may not answer DHCP on the network's shared L2, so a
+// compromised pod cannot hand out addresses, gateways or DNS servers to its
+// neighbors. Replies of DHCPv4 servers and relays come from port 67, those
+// of DHCPv6 from port 547. Pods that run the network's DHCP server are
+// allowed with the "dhcpServer" pod argument.
+
+func dhcpGuardPort(pod podArgs, pipeline *portPipeline) error {
+	server, err := pod.bool("dhcpServer", false)
+	if err != nil || server {
+		return err
+	}
+	pipeline.drop(featureDhcpGuard, "udp,tp_src=67")
+	pipeline.drop(featureDhcpGuard, "udp6,tp_src=547")
+	return nil
+}
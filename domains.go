@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var portDescPattern = regexp.MustCompile(`^\s*(\w+)\((.+)\): addr:`)
+
+// broadcastDomain sums up one VLAN of a bridge: the ports in it, how many of
+// them broadcast and unknown unicast is flooded to, and the MACs learned
+type broadcastDomain struct {
+	ports    int
+	flooding int
+	macs     int
+}
+
+// cmdDomains shows how large the L2 domains on the node's bridges have grown:
+//
+//	rainier domains [-bridge name]
+func cmdDomains(args []string) error {
+	flags := flag.NewFlagSet("domains", flag.ContinueOnError)
+	bridge := flags.String("bridge", "", "only show this bridge")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bridges := []string{*bridge}
+	if *bridge == "" {
+		out, err := vsctl("list-br")
+		if err != nil {
+			return err
+		}
+		bridges = strings.Fields(out)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BRIDGE\tVLAN\tPORTS\tFLOODING\tMACS")
+	for _, bridgeName := range bridges {
+		domains, err := broadcastDomains(bridgeName)
+		if err != nil {
+			return err
+		}
+		vlans := []int{}
+		for vlan := range domains {
+			vlans = append(vlans, vlan)
+		}
+		sort.Ints(vlans)
+		for _, vlan := range vlans {
+			d := domains[vlan]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", bridgeName, vlan, d.ports, d.flooding, d.macs)
+		}
+	}
+	return w.Flush()
+}
+
+func broadcastDomains(bridgeName string) (map[int]*broadcastDomain, error) {
+	domains := make(map[int]*broadcastDomain)
+	domain := func(vlan int) *broadcastDomain {
+		if domains[vlan] == nil {
+			domains[vlan] = &broadcastDomain{}
+		}
+		return domains[vlan]
+	}
+
+	// Ports that do not flood
+	out, err := ofctl("dump-ports-desc", bridgeName)
+	if err != nil {
+		return nil, err
+	}
+	noFlood := make(map[string]bool)
+	name := ""
+	for _, line := range strings.Split(out, "\n") {
+		if m := portDescPattern.FindStringSubmatch(line); m != nil {
+			name = m[2]
+		} else if strings.Contains(line, "config:") && strings.Contains(line, "NO_FLOOD") {
+			noFlood[name] = true
+		}
+	}
+
+	// Access ports belong to their tag's VLAN, trunks to every VLAN they carry
+	out, err = vsctl("list-ports", bridgeName)
+	if err != nil {
+		return nil, err
+	}
+	trunks := []string{}
+	for _, port := range strings.Fields(out) {
+		tag, err := vsctl("get", "port", port, "tag")
+		if err != nil {
+			return nil, err
+		}
+		vlans := []int{}
+		if vlan, err := strconv.Atoi(tag); err == nil {
+			vlans = append(vlans, vlan)
+		} else {
+			carried, err := vsctl("get", "port", port, "trunks")
+			if err != nil {
+				return nil, err
+			}
+			carried = strings.Trim(carried, "[]")
+			if carried == "" {
+				trunks = append(trunks, port)
+				continue
+			}
+			for _, field := range strings.Split(carried, ",") {
+				if vlan, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+					vlans = append(vlans, vlan)
+				}
+			}
+		}
+		for _, vlan := range vlans {
+			d := domain(vlan)
+			d.ports++
+			if !noFlood[port] {
+				d.flooding++
+			}
+		}
+	}
+
+	// Learned MACs
+	out, err = ovsExec("ovs-appctl", "fdb/show", bridgeName)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(out, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		if vlan, err := strconv.Atoi(fields[1]); err == nil {
+			domain(vlan).macs++
+		}
+	}
+
+	// Trunks carrying every VLAN are part of all domains, untagged included
+	if len(trunks) > 0 {
+		domain(0)
+	}
+	for _, d := range domains {
+		for _, port := range trunks {
+			d.ports++
+			if !noFlood[port] {
+				d.flooding++
+			}
+		}
+	}
+	return domains, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// cmdDrops shows how many packets rainier's drop flows dropped, per feature
+// and per container, to point "my pod can't connect" at the feature
+// responsible:
+//
+//	rainier drops [-bridge name]
+func cmdDrops(args []string) error {
+	flags := flag.NewFlagSet("drops", flag.ContinueOnError)
+	bridge := flags.String("bridge", "", "only show this bridge")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bridges := []string{*bridge}
+	if *bridge == "" {
+		out, err := vsctl("list-br")
+		if err != nil {
+			return err
+		}
+		bridges = strings.Fields(out)
+	}
+
+	// Containers by OpenFlow port
+	containers := make(map[string]string)
+	readHostInterfacesFromFile()
+	for key, hostIfName := range hostInterfaces {
+		if ofport, err := getOfport(hostIfName.(string)); err == nil {
+			containers[strconv.Itoa(ofport)] = shortID(keyContainerID(key))
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BRIDGE\tFEATURE\tCONTAINER\tPACKETS")
+	for _, bridgeName := range bridges {
+		counts, err := dropCounts(bridgeName)
+		if err != nil {
+			return err
+		}
+		keys := []string{}
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			parts := strings.SplitN(key, "\t", 2)
+			container := containers[parts[1]]
+			if container == "" {
+				container = "port " + parts[1]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", bridgeName, parts[0], container, counts[key])
+		}
+	}
+	return w.Flush()
+}
+
+// dropCounts sums the packets of rainier's drop flows by feature and owner
+func dropCounts(bridgeName string) (map[string]uint64, error) {
+	match := fmt.Sprintf("cookie=%#x/%#x", cookieMagic<<cookieMagicShift, cookieMagicMask)
+	out, err := ofctl("dump-flows", bridgeName, match)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to dump flows of bridge %s. Error = %s", bridgeName, err)
+	}
+	counts := make(map[string]uint64)
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasSuffix(strings.TrimSpace(line), "actions=drop") {
+			continue
+		}
+		value, _ := flowField(line, "cookie")
+		cookie, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+		value, _ = flowField(line, "n_packets")
+		packets, _ := strconv.ParseUint(value, 10, 64)
+
+		feature := featureNames[uint8(cookie&cookieFeatureMask>>cookieFeatureShift)]
+		owner := strconv.FormatUint(cookie&cookieOwnerMask, 10)
+		counts[feature+"\t"+owner] += packets
+	}
+	return counts, nil
+}
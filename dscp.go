@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	DscpTrust   = "trust"
+	DscpRewrite = "rewrite"
+	DscpStrip   = "strip"
+)
+
+// Dscp sets what happens to the DSCP marking of packets sent by containers:
+// trust keeps it, rewrite replaces it with Value and strip clears it
+type Dscp struct {
+	Policy string `json:"policy"`
+	Value  int    `json:"value"`
+}
+
+func validateDscp(dscp *Dscp) error {
+	if dscp == nil {
+		return nil
+	}
+	switch dscp.Policy {
+	case DscpTrust, DscpStrip:
+	case DscpRewrite:
+		if dscp.Value < 0 || dscp.Value > 63 {
+			return fmt.Errorf("dscp value must be within 0-63")
+		}
+	default:
+		return fmt.Errorf("invalid dscp policy %q", dscp.Policy)
+	}
+	return nil
+}
+
+func dscpPort(dscp *Dscp, pipeline *portPipeline) {
+	value := dscp.Value
+	switch dscp.Policy {
+	case DscpTrust:
+		return
+	case DscpStrip:
+		value = 0
+	}
+	for _, class := range []string{"ip", "ipv6"} {
+		pipeline.add(class, fmt.Sprintf("set_field:%d->ip_dscp", value))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// Dual-stack IPAM results carry addresses of both families on the one
+// container interface. IPAM configurations often list a default route for
+// one family only, which leaves the container reachable over both families
+// but able to start connections over one. dualStackResult gives the other
+// family a default route through its gateway too.
+func dualStackResult(result *current.Result) {
+	hasDefault := make(map[string]bool)
+	for _, route := range result.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			hasDefault[ipVersion(route.Dst.IP)] = true
+		}
+	}
+	if len(hasDefault) == 0 {
+		// IPAM asked for no default route at all
+		return
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil || hasDefault[ipVersion(ipc.Address.IP)] {
+			continue
+		}
+		_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+		if ipVersion(ipc.Address.IP) == "6" {
+			_, dst, _ = net.ParseCIDR("::/0")
+		}
+		result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: ipc.Gateway})
+		hasDefault[ipVersion(ipc.Address.IP)] = true
+	}
+}
+
+func ipVersion(ip net.IP) string {
+	if ip.To4() != nil {
+		return "4"
+	}
+	return "6"
+}
+
+// enableIPv6 turns IPv6 on for the container interface when it gets IPv6
+// addresses, as runtimes may create namespaces with IPv6 disabled. Must run
+// in the container's namespace.
+func enableIPv6(ifName string, result *current.Result) error {
+	for _, ipc := range result.IPs {
+		if ipVersion(ipc.Address.IP) != "6" {
+			continue
+		}
+		path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", ifName)
+		if err := ioutil.WriteFile(path, []byte("0"), 0644); err != nil {
+			return fmt.Errorf("failed to enable IPv6 on %s: %v", ifName, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// IPAM may return several addresses per family. ipFamilies keeps the
+// families a network wants, e.g. IPv4 only from a dual-stack pool, and
+// preferredFamily moves that family's addresses to the front: kubelet takes
+// the first address for the pod's IP. Within a family IPAM's order is kept,
+// so the first address is the interface's primary one and the kernel makes
+// later ones in the same subnet secondary addresses. Addresses left out stay
+// allocated until DEL releases the container's addresses.
+
+func validateIPFamilies(config *RainierConfig) error {
+	families := append([]string{}, config.IPFamilies...)
+	if config.PreferredFamily != "" {
+		families = append(families, config.PreferredFamily)
+	}
+	for _, family := range families {
+		if family != "4" && family != "6" {
+			return fmt.Errorf("invalid IP family %q, want 4 or 6", family)
+		}
+	}
+	return nil
+}
+
+// selectIPs applies ipFamilies and preferredFamily to the IPAM result
+func selectIPs(config *RainierConfig, result *current.Result) error {
+	if len(config.IPFamilies) > 0 && len(result.IPs) > 0 {
+		wanted := make(map[string]bool)
+		for _, family := range config.IPFamilies {
+			wanted[family] = true
+		}
+		ips := []*current.IPConfig{}
+		for _, ipc := range result.IPs {
+			if wanted[ipVersion(ipc.Address.IP)] {
+				ips = append(ips, ipc)
+			}
+		}
+		routes := []*types.Route{}
+		for _, route := range result.Routes {
+			if wanted[ipVersion(route.Dst.IP)] {
+				routes = append(routes, route)
+			}
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("IPAM returned no address of ipFamilies %v", config.IPFamilies)
+		}
+		result.IPs, result.Routes = ips, routes
+	}
+	if config.PreferredFamily != "" {
+		sort.SliceStable(result.IPs, func(i, j int) bool {
+			return ipVersion(result.IPs[i].Address.IP) == config.PreferredFamily && ipVersion(result.IPs[j].Address.IP) != config.PreferredFamily
+		})
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const DefaultOvsTimeout = 30
+const MaxOvsOutput = 16 << 20
+
+var ovsTimeout = DefaultOvsTimeout * time.Second
+
+// cappedBuffer keeps at most limit bytes so that a runaway command cannot
+// exhaust the plugin's memory
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.Buffer.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// runOvs executes every OVS command rainier issues, including the ones
+// issued by go-openvswitch, which is handed runOvs through ovs.Exec. The
+// command runs in its own process group so that a hung sudo and everything
+// it spawned can be killed together, and it is always waited for so that no
+// zombie is left behind.
+func runOvs(cmd string, args ...string) ([]byte, error) {
+	if err := breakerOpen(); err != nil {
+		return nil, err
+	}
+	timeout := withinDeadline(ovsTimeout)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("%s not run, deadline exceeded", cmd)
+	}
+
+	c := exec.Command("sudo", append([]string{cmd}, args...)...)
+	out := &cappedBuffer{limit: MaxOvsOutput}
+	c.Stdout = out
+	c.Stderr = out
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := c.Start(); err != nil {
+		breakerRecord(err, nil)
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	var err error
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = fmt.Errorf("%s timed out after %s", cmd, timeout)
+	}
+
+	if out.truncated {
+		out.WriteString("\n(output truncated)")
+	}
+	breakerRecord(err, out.Bytes())
+	return out.Bytes(), err
+}
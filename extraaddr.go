@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+)
+
+// ExtraAddress is installed in the container on top of what IPAM assigned,
+// e.g. an anycast VIP on lo. Interface defaults to the container interface.
+type ExtraAddress struct {
+	Address   string `json:"address"`
+	Interface string `json:"interface"`
+}
+
+func validateExtraAddresses(extra []ExtraAddress) error {
+	for _, e := range extra {
+		if _, _, err := net.ParseCIDR(e.Address); err != nil {
+			return fmt.Errorf("extraAddresses has invalid address %q", e.Address)
+		}
+	}
+	return nil
+}
+
+// addExtraAddresses must run in the container's namespace. It adds the
+// addresses to the result, together with any interface besides ifName they
+// were installed on.
+func addExtraAddresses(extra []ExtraAddress, ifName string, sandbox string, result *current.Result) error {
+	for _, e := range extra {
+		name := e.Interface
+		if name == "" {
+			name = ifName
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find %s in container: %v", name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %s up: %v", name, err)
+		}
+
+		ip, ipnet, _ := net.ParseCIDR(e.Address)
+		ipnet.IP = ip
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+			return fmt.Errorf("failed to add %s to %s: %v", e.Address, name, err)
+		}
+
+		index := -1
+		for i, iface := range result.Interfaces {
+			if iface.Name == name && iface.Sandbox == sandbox {
+				index = i
+			}
+		}
+		if index < 0 {
+			result.Interfaces = append(result.Interfaces, &current.Interface{
+				Name:    name,
+				Mac:     link.Attrs().HardwareAddr.String(),
+				Sandbox: sandbox,
+			})
+			index = len(result.Interfaces) - 1
+		}
+
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Interface: current.Int(index),
+			Address:   *ipnet,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// FaultsEnv injects failures and delays into ADD and DEL, for chaos testing
+// how runtimes and kubelet cope with a failing CNI plugin. It holds
+// step=action pairs separated by commas, where step is a step of the
+// operation report, e.g. addPort, ipamAdd or configureInterface, and action
+// is fail, retry (fail with a retryable error) or delay:<duration>:
+//
+//	RAINIER_FAULTS=ipamAdd=delay:5s,addPort=fail
+//
+// Never set it on a production node.
+const FaultsEnv = "RAINIER_FAULTS"
+
+// injectFault runs the fault configured for a step, if any
+func injectFault(step string) error {
+	faults := os.Getenv(FaultsEnv)
+	if faults == "" {
+		return nil
+	}
+	for _, fault := range strings.Split(faults, ",") {
+		kv := strings.SplitN(strings.TrimSpace(fault), "=", 2)
+		if len(kv) != 2 || kv[0] != step {
+			continue
+		}
+		action := kv[1]
+		switch {
+		case action == "fail":
+			return fmt.Errorf("injected failure at step %s", step)
+		case action == "retry":
+			return &types.Error{
+				Code: ErrTryAgainLater,
+				Msg:  fmt.Sprintf("injected retryable failure at step %s", step),
+			}
+		case strings.HasPrefix(action, "delay:"):
+			if delay, err := time.ParseDuration(strings.TrimPrefix(action, "delay:")); err == nil {
+				time.Sleep(delay)
+			}
+		}
+	}
+	return nil
+}
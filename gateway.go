@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// The bridge's internal interface is how the host reaches containers in
+// bridge mode. When it has addresses of one family only while containers are
+// dual-stack, the host and everything it routes for reach them over that
+// family only, which looks like a container that half works.
+
+// setBridgeGateway gives the bridge interface the gateway address of every
+// family IPAM returned, so the host routes for the containers
+func setBridgeGateway(bridgeName string, result *current.Result) error {
+	link, err := bridgeLink(bridgeName)
+	if err != nil {
+		return err
+	}
+	return setGatewayAddresses(link, result)
+}
+
+func setGatewayAddresses(link netlink.Link, result *current.Result) error {
+	name := link.Attrs().Name
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ipc.Gateway, Mask: ipc.Address.Mask}}
+		if err := netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add gateway %s to %s: %v", addr.IPNet, name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %s up: %v", name, err)
+	}
+	return nil
+}
+
+// With gatewayPort the gateway is an internal port of its own on the bridge
+// rather than the bridge's interface, which other software on the node, e.g.
+// an uplink bond or a host IP, may be configured on. Containers get a default
+// route through it and the host routes, and with ipMasq masquerades, what
+// they send beyond their subnet, as the bridge plugin does.
+
+func validateGatewayPort(config *RainierConfig) error {
+	if config.GatewayPort == "" {
+		if config.IPMasq && !config.IsGateway && config.Mode != ModePtp {
+			return fmt.Errorf("ipMasq needs isGateway, gatewayPort or ptp mode")
+		}
+		return nil
+	}
+	if config.Mode != "" && config.Mode != ModeBridge {
+		return fmt.Errorf("gatewayPort can only be used in bridge mode")
+	}
+	if config.IsGateway {
+		return fmt.Errorf("gatewayPort and isGateway cannot be used together")
+	}
+	return validateIfName(config.GatewayPort)
+}
+
+// ensureGatewayPort adds the internal port to the bridge and gives it the
+// gateway addresses of the container's subnets
+func ensureGatewayPort(bridgeName string, portName string, mtu int, result *current.Result) error {
+	_, err := vsctl("--may-exist", "add-port", bridgeName, portName,
+		"--", "set", "interface", portName, "type=internal", "mtu_request="+strconv.Itoa(mtu))
+	if err != nil {
+		return fmt.Errorf("Failed to add gateway port %s to bridge %s. Error = %s", portName, bridgeName, err)
+	}
+	link, err := netlink.LinkByName(portName)
+	if err != nil {
+		return fmt.Errorf("failed to find gateway port %s: %v", portName, err)
+	}
+	if err := setGatewayAddresses(link, result); err != nil {
+		return err
+	}
+	for _, ipc := range result.IPs {
+		if ipVersion(ipc.Address.IP) == "6" {
+			err = ip.EnableIP6Forward()
+		} else {
+			err = ip.EnableIP4Forward()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+	}
+	return nil
+}
+
+// gatewayResult gives every family with a gateway a default route through
+// it, unless IPAM returned a default route for the family
+func gatewayResult(result *current.Result) {
+	hasDefault := make(map[string]bool)
+	for _, route := range result.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			hasDefault[ipVersion(route.Dst.IP)] = true
+		}
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil || hasDefault[ipVersion(ipc.Address.IP)] {
+			continue
+		}
+		_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+		if ipVersion(ipc.Address.IP) == "6" {
+			_, dst, _ = net.ParseCIDR("::/0")
+		}
+		result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: ipc.Gateway})
+		hasDefault[ipVersion(ipc.Address.IP)] = true
+	}
+}
+
+// Masquerading gives containers outbound connectivity, e.g. to the internet
+// through the node's uplink, without a router that knows their subnets.
+// Traffic within the subnets and multicast keep their source address.
+func setupIPMasq(config *RainierConfig, containerID string, subnets []*net.IPNet) error {
+	chain := utils.FormatChainName(config.Name, containerID)
+	comment := utils.FormatComment(config.Name, containerID)
+	for _, subnet := range subnets {
+		if err := ip.SetupIPMasq(subnet, chain, comment); err != nil {
+			return fmt.Errorf("failed to set up masquerading for %s: %v", subnet.IP, err)
+		}
+	}
+	return nil
+}
+
+// checkIPMasq reports the container's masquerading chains that are missing,
+// e.g. after a firewalld reload flushed them, and restores them when asked to
+func checkIPMasq(config *RainierConfig, containerID string, result *current.Result, repair bool) []string {
+	chain := utils.FormatChainName(config.Name, containerID)
+	problems := []string{}
+	checked := make(map[string]bool)
+	for _, ipc := range result.IPs {
+		version := ipVersion(ipc.Address.IP)
+		if checked[version] {
+			continue
+		}
+		checked[version] = true
+		ipt, err := iptablesFor(version)
+		if err != nil {
+			return append(problems, err.Error())
+		}
+		if exists, err := ipt.ChainExists("nat", chain); err != nil || !exists {
+			problems = append(problems, fmt.Sprintf("IPv%s masquerading chain %s is missing", version, chain))
+		}
+	}
+	if len(problems) == 0 || !repair {
+		return problems
+	}
+	if err := setupIPMasq(config, containerID, resultSubnets(result)); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// resultSubnets returns the container's addresses within their subnets
+func resultSubnets(result *current.Result) []*net.IPNet {
+	subnets := []*net.IPNet{}
+	for _, ipc := range result.IPs {
+		subnets = append(subnets, &net.IPNet{IP: ipc.Address.IP, Mask: ipc.Address.Mask})
+	}
+	return subnets
+}
+
+func teardownIPMasq(config *RainierConfig, containerID string, owned []string) error {
+	chain := utils.FormatChainName(config.Name, containerID)
+	comment := utils.FormatComment(config.Name, containerID)
+	for _, address := range owned {
+		addr := net.ParseIP(address)
+		if addr == nil {
+			continue
+		}
+		bits := 128
+		if addr.To4() != nil {
+			bits = 32
+		}
+		ipn := &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}
+		if err := ip.TeardownIPMasq(ipn, chain, comment); err != nil {
+			return fmt.Errorf("failed to tear down masquerading for %s: %v", address, err)
+		}
+	}
+	return nil
+}
+
+// checkBridgeFamilies reports address families a container has but the
+// bridge interface lacks, when the bridge has addresses of another family
+func checkBridgeFamilies(bridgeName string, result *current.Result) []string {
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list addresses of %s: %v", bridgeName, err)}
+	}
+	bridgeFamilies := make(map[string]bool)
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if addr.IP.To4() != nil {
+			bridgeFamilies["4"] = true
+		} else {
+			bridgeFamilies["6"] = true
+		}
+	}
+	if len(bridgeFamilies) == 0 {
+		return nil
+	}
+
+	problems := []string{}
+	for _, ipc := range result.IPs {
+		if !bridgeFamilies[ipVersion(ipc.Address.IP)] {
+			problems = append(problems, fmt.Sprintf("%s has no IPv%s address, so the host cannot reach %s",
+				bridgeName, ipVersion(ipc.Address.IP), ipc.Address.IP))
+			bridgeFamilies[ipVersion(ipc.Address.IP)] = true
+		}
+	}
+	return problems
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+)
+
+// GC, from CNI 1.1, hands the plugin the attachments the runtime still
+// knows of, so that whatever leaked with the others can go: attachments
+// whose DEL never ran or failed, and host veths nobody owns. Several
+// networks may share rainier's state and bridge, so an attachment is only
+// collected when it is the network's, its port is on the network's bridge
+// and, when the port says so, belongs to the network, or when its veth and
+// port are gone altogether. IPAM keeps the addresses of collected
+// attachments until its own GC or DEL.
+
+type gcConf struct {
+	ValidAttachments []struct {
+		ContainerID string `json:"containerID"`
+		IfName      string `json:"ifname"`
+	} `json:"cni.dev/valid-attachments"`
+}
+
+func cmdGC(args *skel.CmdArgs) error {
+	stdinData := args.StdinData
+	config, err := loadConfig(stdinData)
+	if err != nil {
+		return err
+	}
+	gc := &gcConf{}
+	if err := json.Unmarshal(stdinData, gc); err != nil {
+		return fmt.Errorf("failed to parse valid attachments: %v", err)
+	}
+	valid := make(map[string]bool)
+	for _, attachment := range gc.ValidAttachments {
+		valid[attachmentKey(config.Name, attachment.ContainerID, attachment.IfName)] = true
+	}
+
+	// Leave the dataplane alone during maintenance
+	if err := maintenanceMode(); err != nil {
+		return err
+	}
+	unlock, err := lockPorts(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, attachment := range gc.ValidAttachments {
+		if err := migrateLegacyState(config.Name, attachment.ContainerID, attachment.IfName); err != nil {
+			return err
+		}
+	}
+	readHostInterfacesFromFile()
+	for key, name := range hostInterfaces {
+		// Entries an older version keyed by container ID alone are still
+		// here when none of the container's attachments is valid
+		if network, _, _ := splitAttachmentKey(key); valid[key] || (network != config.Name && network != "") {
+			continue
+		}
+		hostIfName := name.(string)
+		if !collectable(config, hostIfName) {
+			continue
+		}
+		if err := collectContainer(config, key, hostIfName); err != nil {
+			return err
+		}
+	}
+
+	// Veths left behind before they became ports or got recorded
+	leaked, err := leakedVeths()
+	if err != nil {
+		return err
+	}
+	for _, link := range leaked {
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", link.Attrs().Name, err)
+		}
+	}
+
+	// VLAN ports of attachments that lost their veth
+	if err := releaseOrphanVlanPorts(); err != nil {
+		return err
+	}
+
+	// The segment of a network none of whose attachments is valid
+	if config.VNI != 0 {
+		return releaseSegmentTag(config.PublicBridgeName, config.VNI)
+	}
+	return nil
+}
+
+// collectable tells whether the port of an attachment that is no longer
+// valid belongs to the network GC runs for
+func collectable(config *RainierConfig, hostIfName string) bool {
+	bridgeName, err := vsctl("port-to-br", hostIfName)
+	if err != nil {
+		_, err := netlink.LinkByName(hostIfName)
+		return err != nil
+	}
+	if bridgeName != config.PublicBridgeName {
+		return false
+	}
+	network := interfaceExternalID(hostIfName, "rainier-network")
+	return network == "" || network == config.Name
+}
+
+// collectContainer undoes on the host what ADD did for an attachment, as DEL
+// does short of IPAM
+func collectContainer(config *RainierConfig, key string, hostIfName string) error {
+	// The name may have been taken by a port of another tool since
+	tools, err := portTools()
+	if err != nil {
+		return err
+	}
+	if tools[hostIfName] != "" {
+		return forgetAttachment(key)
+	}
+
+	if ofport, err := getOfport(hostIfName); err == nil {
+		if err := dataplane.DeletePortFlows(config.PublicBridgeName, ofport); err != nil {
+			return err
+		}
+		if config.NeighborRateLimit != nil {
+			if err := deleteNeighborMeter(config.PublicBridgeName, ofport); err != nil {
+				return err
+			}
+		}
+	}
+	if err := clearPortBandwidth(hostIfName); err != nil {
+		return err
+	}
+	if err := dataplane.DeletePort(config.PublicBridgeName, hostIfName); err != nil {
+		return err
+	}
+	if link, err := netlink.LinkByName(hostIfName); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", hostIfName, err)
+		}
+	}
+
+	readAddressesFromFile()
+	containerID := keyContainerID(key)
+	if config.Mode == ModePtp {
+		if err := teardownPtpHost(config.PublicBridgeName, addresses[key]); err != nil {
+			return err
+		}
+	}
+	if config.IPMasq {
+		if err := teardownIPMasq(config, containerID, addresses[key]); err != nil {
+			return err
+		}
+	}
+	if err := teardownHostPorts(config, containerID); err != nil {
+		return err
+	}
+	if err := releaseVlanPorts(key); err != nil {
+		return err
+	}
+
+	return forgetAttachment(key)
+}
+
+// forgetAttachment removes an attachment from rainier's state
+func forgetAttachment(key string) error {
+	if err := forgetHostInterface(key); err != nil {
+		return err
+	}
+	forgetAddresses(key)
+	forgetMode(key)
+	forgetPodArgs(key)
+	forgetHostDevice(key)
+	if network, containerID, ifName := splitAttachmentKey(key); network != "" {
+		forgetCachedResult(network, containerID, ifName)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const TunnelTypeGeneve = "geneve"
+const MaxTunMetadata = 64
+const MaxGeneveOptionLen = 124
+
+// GeneveOption is a Geneve TLV that every packet the network's containers
+// send out of a Geneve tunnel carries, e.g. the tenant context an OVN-style
+// fabric expects. OVS matches and sets TLVs through tun_metadata fields,
+// mapped to TLVs bridge-wide, so networks sharing a bridge share mappings.
+type GeneveOption struct {
+	Class uint16 `json:"class"`
+	Type  uint8  `json:"type"`
+	Value string `json:"value"`
+}
+
+func (o GeneveOption) value() []byte {
+	value, _ := hex.DecodeString(strings.TrimPrefix(o.Value, "0x"))
+	return value
+}
+
+func (o GeneveOption) tlv() string {
+	return fmt.Sprintf("{class=%#x,type=%#x,len=%d}", o.Class, o.Type, len(o.value()))
+}
+
+func validateGeneveOptions(config *RainierConfig) error {
+	if len(config.GeneveOptions) > 0 && config.Mode != "" && config.Mode != ModeBridge {
+		return fmt.Errorf("geneveOptions can only be used in bridge mode")
+	}
+	for _, o := range config.GeneveOptions {
+		value, err := hex.DecodeString(strings.TrimPrefix(o.Value, "0x"))
+		if err != nil || len(value) == 0 || len(value)%4 != 0 || len(value) > MaxGeneveOptionLen {
+			return fmt.Errorf("geneve option class %#x type %#x needs a hex value of 4 to %d bytes in steps of 4",
+				o.Class, o.Type, MaxGeneveOptionLen)
+		}
+	}
+	return nil
+}
+
+// geneveTlvMap returns the tun_metadata index of every TLV mapped on the
+// bridge
+func geneveTlvMap(bridgeName string) (map[string]int, error) {
+	out, err := ofctl("dump-tlv-map", bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to dump TLV map of bridge %s. Error = %s", bridgeName, err)
+	}
+	mapped := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 || !strings.HasPrefix(fields[3], "tun_metadata") {
+			continue
+		}
+		class, err1 := strconv.ParseUint(fields[0], 0, 16)
+		tlvType, err2 := strconv.ParseUint(fields[1], 0, 8)
+		length, err3 := strconv.Atoi(fields[2])
+		index, err4 := strconv.Atoi(strings.TrimPrefix(fields[3], "tun_metadata"))
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		mapped[fmt.Sprintf("{class=%#x,type=%#x,len=%d}", class, tlvType, length)] = index
+	}
+	return mapped, nil
+}
+
+// ensureGeneveTlvMap maps the network's TLVs to free tun_metadata fields
+// unless they are mapped already
+func ensureGeneveTlvMap(bridgeName string, options []GeneveOption) error {
+	mapped, err := geneveTlvMap(bridgeName)
+	if err != nil {
+		return err
+	}
+	used := make(map[int]bool)
+	for _, index := range mapped {
+		used[index] = true
+	}
+	for _, o := range options {
+		if _, ok := mapped[o.tlv()]; ok {
+			continue
+		}
+		index := 0
+		for used[index] {
+			index++
+		}
+		if index >= MaxTunMetadata {
+			return fmt.Errorf("no free tun_metadata field on bridge %s for geneve option %s", bridgeName, o.tlv())
+		}
+		mapping := fmt.Sprintf("%s->tun_metadata%d", o.tlv(), index)
+		if _, err := ofctl("add-tlv-map", bridgeName, mapping); err != nil {
+			return fmt.Errorf("Failed to map geneve option %s on bridge %s. Error = %s", mapping, bridgeName, err)
+		}
+		mapped[o.tlv()] = index
+		used[index] = true
+	}
+	return nil
+}
+
+// genevePort sets the network's TLVs on all of the port's traffic. They only
+// go on the wire when the packet leaves through a Geneve tunnel.
+func genevePort(bridgeName string, options []GeneveOption, pipeline *portPipeline) error {
+	mapped, err := geneveTlvMap(bridgeName)
+	if err != nil {
+		return err
+	}
+	for _, o := range options {
+		index, ok := mapped[o.tlv()]
+		if !ok {
+			return fmt.Errorf("geneve option %s is not mapped on bridge %s", o.tlv(), bridgeName)
+		}
+		pipeline.add("", fmt.Sprintf("set_field:0x%x->tun_metadata%d", o.value(), index))
+	}
+	return nil
+}
@@ -1,24 +1,17 @@
 module github.com/charlesmchan/rainier
 
+go 1.21
+
 require (
-	github.com/containernetworking/cni v0.0.0-20180705210735-e67bb289cccf
-	github.com/containernetworking/plugins v0.0.0-20180718140248-21e3e4ec01db
-	github.com/coreos/go-iptables v0.3.0 // indirect
+	github.com/containernetworking/cni v1.3.0
+	github.com/containernetworking/plugins v1.4.1
+	github.com/coreos/go-iptables v0.7.0
 	github.com/digitalocean/go-openvswitch v0.0.0-20180604155157-813765f6db70
-	github.com/fsnotify/fsnotify v1.4.7 // indirect
-	github.com/golang/protobuf v1.2.0 // indirect
-	github.com/google/go-cmp v0.2.0 // indirect
-	github.com/hpcloud/tail v1.0.0 // indirect
-	github.com/onsi/ginkgo v1.6.0 // indirect
-	github.com/onsi/gomega v1.4.1 // indirect
-	github.com/safchain/ethtool v0.0.0-20180504150752-6e3f4faa84e1 // indirect
-	github.com/vishvananda/netlink v0.0.0-20180623192917-028453c77ce5 // indirect
-	github.com/vishvananda/netns v0.0.0-20171111001504-be1fbeda1936 // indirect
-	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
-	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
-	golang.org/x/sys v0.0.0-20180622082034-63fc586f45fe // indirect
-	golang.org/x/text v0.3.0 // indirect
-	gopkg.in/fsnotify.v1 v1.4.7 // indirect
-	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
-	gopkg.in/yaml.v2 v2.2.1 // indirect
+	github.com/vishvananda/netlink v1.3.0
+)
+
+require (
+	github.com/safchain/ethtool v0.3.0 // indirect
+	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/sys v0.23.0 // indirect
 )
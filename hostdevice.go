@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const ModeHostDevice = "host-device"
+const HostDeviceJson = StateDir + "/host-devices.json"
+
+// HostDevice is the host NIC that host-device mode moves into the pod, for
+// appliances that need a NIC of their own. With Vlan set, or a "vlan" pod
+// argument, a VLAN subinterface of the NIC is created and moved instead,
+// and deleted again on DEL. OVS is not involved in this mode.
+type HostDevice struct {
+	Name string `json:"name"`
+	Vlan int    `json:"vlan"`
+}
+
+// hostDevice is what DEL needs to give a NIC back as it found it. When the
+// pod's namespace goes away first, the kernel moves the NIC back to the host
+// under its name in the pod, or as devN when that is taken. It is found by
+// its ifindex, which moving keeps unless the index is taken, or by its MAC,
+// the original one or the one the pod asked for.
+type hostDevice struct {
+	Name   string `json:"name"`
+	Index  int    `json:"index"`
+	MAC    string `json:"mac"`
+	PodMAC string `json:"podMac,omitempty"`
+}
+
+var hostDevices = make(map[string]hostDevice)
+
+func validateHostDevice(hd *HostDevice) error {
+	if hd == nil || hd.Name == "" {
+		return fmt.Errorf("host-device mode needs a hostDevice name")
+	}
+	if hd.Vlan != 0 {
+		return validateVlan(hd.Vlan)
+	}
+	return nil
+}
+
+func cmdAddHostDevice(config *RainierConfig, args *skel.CmdArgs, report *opReport) error {
+	// Get name space
+	if err := report.step("openNetns"); err != nil {
+		return err
+	}
+	netns, err := openNetns(args.Netns)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	// Pick the device, creating the VLAN subinterface if asked to, by the
+	// network or by the pod
+	if err := report.step("prepareDevice"); err != nil {
+		return err
+	}
+	pod := loadPodArgs(config, args.Args)
+	vlan, err := podVlan(config, pod)
+	if err != nil {
+		return err
+	}
+	if vlan == 0 {
+		vlan = config.HostDevice.Vlan
+	}
+	name := config.HostDevice.Name
+	if vlan != 0 {
+		if name, err = ensureVlanSubinterface(name, vlan); err != nil {
+			return err
+		}
+	}
+	mac, err := requestedMAC(config, pod)
+	if err != nil {
+		return err
+	}
+
+	// Record the device and move it into the container, so that DEL or
+	// the rollback can give it back even if the move or a later step fails
+	if err := report.step("moveDevice"); err != nil {
+		return err
+	}
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find host device %s: %v", name, err)
+	}
+	device := hostDevice{Name: name, Index: link.Attrs().Index, MAC: link.Attrs().HardwareAddr.String()}
+	if mac != nil {
+		device.PodMAC = mac.String()
+	}
+	if err := recordHostDevice(key, device); err != nil {
+		return err
+	}
+	if err := recordHostInterface(key, name); err != nil {
+		return err
+	}
+	containerInterface, err := moveDeviceIn(netns, name, args.IfName)
+	if err != nil {
+		return err
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		if mac == nil {
+			return nil
+		}
+		containerInterface.Mac = mac.String()
+		return setLinkMAC(args.IfName, mac)
+	})
+	if err != nil {
+		return err
+	}
+
+	return configureAttachment(config, args, report, netns, pod, containerInterface)
+}
+
+func moveDeviceIn(netns ns.NetNS, name string, ifName string) (*current.Interface, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find host device %s: %v", name, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return nil, fmt.Errorf("failed to set %s down: %v", name, err)
+	}
+	if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+		return nil, fmt.Errorf("failed to move %s into %s: %v", name, netns.Path(), err)
+	}
+
+	iface := &current.Interface{Name: ifName, Sandbox: netns.Path()}
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find %s in container: %v", name, err)
+		}
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %v", name, ifName, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %s up: %v", ifName, err)
+		}
+		iface.Mac = link.Attrs().HardwareAddr.String()
+		return nil
+	})
+	return iface, err
+}
+
+// releaseHostDevice gives the device back to the host under its own name and
+// with its own MAC, or deletes it if rainier created it. A device whose
+// container namespace is already gone was moved back to the host by the
+// kernel, and is renamed and given its MAC back there, or deleted with the
+// namespace if it was a VLAN subinterface.
+func releaseHostDevice(config *RainierConfig, args *skel.CmdArgs) error {
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	readHostInterfacesFromFile()
+	name, ok := hostInterfaces[key].(string)
+	if !ok {
+		return nil
+	}
+	readHostDevicesFromFile()
+	device, saved := hostDevices[key]
+
+	if args.Netns != "" {
+		err := ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
+			// Under its own name when the move failed halfway
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				link, err = netlink.LinkByName(name)
+			}
+			if err != nil {
+				return nil
+			}
+			if name != config.HostDevice.Name {
+				if link.Type() != "vlan" {
+					return nil
+				}
+				return netlink.LinkDel(link)
+			}
+			if saved && !device.matches(link) {
+				return nil
+			}
+			if err := netlink.LinkSetDown(link); err != nil {
+				return fmt.Errorf("failed to set %s down: %v", args.IfName, err)
+			}
+			if err := restoreDeviceMAC(link, device); err != nil {
+				return err
+			}
+			if err := netlink.LinkSetName(link, name); err != nil {
+				return fmt.Errorf("failed to rename %s back to %s: %v", args.IfName, name, err)
+			}
+			if err := netlink.LinkSetNsFd(link, int(hostNS.Fd())); err != nil {
+				return fmt.Errorf("failed to move %s back to the host: %v", name, err)
+			}
+			return nil
+		})
+		if _, gone := err.(ns.NSPathNotExistErr); err != nil && !gone {
+			return err
+		}
+	}
+	if saved && name == config.HostDevice.Name {
+		if err := reclaimHostDevice(device); err != nil {
+			return err
+		}
+	}
+
+	forgetHostDevice(key)
+	return forgetHostInterface(key)
+}
+
+// reclaimHostDevice renames a NIC the kernel moved back to the host and
+// restores its MAC. DEL is retried while the kernel has yet to move it, as
+// it does once the last user of the pod's namespace is gone.
+func reclaimHostDevice(device hostDevice) error {
+	if _, err := netlink.LinkByName(device.Name); err == nil {
+		return nil
+	}
+	link, err := netlink.LinkByIndex(device.Index)
+	if err != nil || !device.matches(link) {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		link = nil
+		for _, candidate := range links {
+			if device.matches(candidate) {
+				link = candidate
+				break
+			}
+		}
+	}
+	if link == nil {
+		return &types.Error{
+			Code: ErrTryAgainLater,
+			Msg:  fmt.Sprintf("host device %s is not back on the host yet", device.Name),
+		}
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %s down: %v", link.Attrs().Name, err)
+	}
+	if err := restoreDeviceMAC(link, device); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetName(link, device.Name); err != nil {
+		return fmt.Errorf("failed to rename %s back to %s: %v", link.Attrs().Name, device.Name, err)
+	}
+	return nil
+}
+
+// matches tells whether a link is the device: a NIC, not a virtual link
+// sharing its MAC, with its ifindex or either of its MACs
+func (d hostDevice) matches(link netlink.Link) bool {
+	if link.Type() != "device" {
+		return false
+	}
+	mac := link.Attrs().HardwareAddr.String()
+	if link.Attrs().Index == d.Index && d.Index != 0 {
+		return true
+	}
+	return mac == d.MAC || (d.PodMAC != "" && mac == d.PodMAC)
+}
+
+func restoreDeviceMAC(link netlink.Link, device hostDevice) error {
+	if device.MAC == "" || link.Attrs().HardwareAddr.String() == device.MAC {
+		return nil
+	}
+	mac, err := net.ParseMAC(device.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid MAC %q of host device %s", device.MAC, device.Name)
+	}
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("failed to restore MAC %s of %s: %v", mac, device.Name, err)
+	}
+	return nil
+}
+
+func readHostDevicesFromFile() error {
+	return readState(HostDeviceJson, &hostDevices)
+}
+
+func recordHostDevice(key string, device hostDevice) error {
+	return updateState(HostDeviceJson, &hostDevices, func() error {
+		hostDevices[key] = device
+		return nil
+	})
+}
+
+func forgetHostDevice(key string) error {
+	return updateState(HostDeviceJson, &hostDevices, func() error {
+		delete(hostDevices, key)
+		return nil
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Runtimes pass a pod's hostPorts through the "portMappings" capability.
+// rainier DNATs connections to the node's addresses on a host port to the
+// pod, with a nat chain per container jumped to from HostPortChain, which
+// PREROUTING and OUTPUT send locally addressed traffic to. The host has to
+// route for the containers: isGateway, gatewayPort or ptp mode. Like with
+// the portmap plugin, connections to 127.0.0.1 are not forwarded. Unlike
+// the portmap plugin, rainier does not leave forwarding the connections to
+// the FORWARD policy: a filter chain per container, jumped to from
+// HostPortChain in the filter table, accepts them.
+const HostPortChain = "RAINIER-HOSTPORTS"
+
+var hostPortTables = []string{"nat", "filter"}
+
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+func validatePortMappings(mappings []PortMapping) error {
+	for _, m := range mappings {
+		if m.HostPort <= 0 || m.HostPort > 65535 || m.ContainerPort <= 0 || m.ContainerPort > 65535 {
+			return fmt.Errorf("invalid port mapping %d:%d", m.HostPort, m.ContainerPort)
+		}
+		switch strings.ToLower(m.Protocol) {
+		case "", "tcp", "udp", "sctp":
+		default:
+			return fmt.Errorf("invalid port mapping protocol %q", m.Protocol)
+		}
+		if m.HostIP != "" && net.ParseIP(m.HostIP) == nil {
+			return fmt.Errorf("invalid port mapping hostIP %q", m.HostIP)
+		}
+	}
+	return nil
+}
+
+func hostPortChain(config *RainierConfig, containerID string) string {
+	return utils.FormatChainName("hostport-"+config.Name, containerID)
+}
+
+// setupHostPorts DNATs every mapping to the container's first address of
+// each family the mapping's hostIP, if any, belongs to, and accepts the
+// forwarded traffic of the mapping's connections
+func setupHostPorts(config *RainierConfig, containerID string, mappings []PortMapping, result *current.Result) error {
+	chain := hostPortChain(config, containerID)
+	comment := utils.FormatComment(config.Name, containerID)
+	families := hostPortRules(mappings, result)
+	for _, version := range []string{"4", "6"} {
+		rules, ok := families[version]
+		if !ok {
+			continue
+		}
+		ipt, err := iptablesFor(version)
+		if err != nil {
+			return err
+		}
+		if err := ensureHostPortChain(ipt); err != nil {
+			return err
+		}
+		for _, table := range hostPortTables {
+			if err := ipt.ClearChain(table, chain); err != nil {
+				return fmt.Errorf("failed to create chain %s: %v", chain, err)
+			}
+			for _, rule := range rules[table] {
+				if err := ipt.Append(table, chain, rule...); err != nil {
+					return fmt.Errorf("failed to add hostPort rule to %s: %v", chain, err)
+				}
+			}
+			jump := []string{"-m", "comment", "--comment", comment, "-j", chain}
+			if err := ipt.AppendUnique(table, HostPortChain, jump...); err != nil {
+				return fmt.Errorf("failed to add jump to %s: %v", chain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hostPortRules returns the rules of the container's chains by family and
+// table. A family's chain is built once, for the first of the container's
+// addresses of that family, as the chains are named after the container
+// rather than the address.
+func hostPortRules(mappings []PortMapping, result *current.Result) map[string]map[string][][]string {
+	families := map[string]map[string][][]string{}
+	for _, ipc := range result.IPs {
+		version := ipVersion(ipc.Address.IP)
+		if _, ok := families[version]; ok {
+			continue
+		}
+		rules := map[string][][]string{}
+		for _, m := range mappings {
+			if m.HostIP != "" && ipVersion(net.ParseIP(m.HostIP)) != version {
+				continue
+			}
+			rules["nat"] = append(rules["nat"], hostPortRule(m, ipc.Address.IP))
+			rules["filter"] = append(rules["filter"], hostPortForwardRules(m, ipc.Address.IP)...)
+		}
+		if len(rules) > 0 {
+			families[version] = rules
+		}
+	}
+	return families
+}
+
+// checkHostPorts reports the container's hostPort chains that are missing,
+// e.g. after a firewalld reload flushed them, and restores them when asked to
+func checkHostPorts(config *RainierConfig, containerID string, mappings []PortMapping, result *current.Result, repair bool) []string {
+	chain := hostPortChain(config, containerID)
+	problems := []string{}
+	families := hostPortRules(mappings, result)
+	for _, version := range []string{"4", "6"} {
+		if _, ok := families[version]; !ok {
+			continue
+		}
+		ipt, err := iptablesFor(version)
+		if err != nil {
+			return append(problems, err.Error())
+		}
+		for _, table := range hostPortTables {
+			if exists, err := ipt.ChainExists(table, chain); err != nil || !exists {
+				problems = append(problems, fmt.Sprintf("IPv%s hostPort chain %s is missing from the %s table", version, chain, table))
+			}
+		}
+	}
+	if len(problems) == 0 || !repair {
+		return problems
+	}
+	if err := setupHostPorts(config, containerID, mappings, result); err != nil {
+		return []string{fmt.Sprintf("failed to restore hostPorts: %v", err)}
+	}
+	return nil
+}
+
+func mappingProtocol(m PortMapping) string {
+	if m.Protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(m.Protocol)
+}
+
+func hostPortRule(m PortMapping, address net.IP) []string {
+	rule := []string{"-p", mappingProtocol(m), "--dport", strconv.Itoa(m.HostPort)}
+	if m.HostIP != "" {
+		rule = append(rule, "-d", m.HostIP)
+	}
+	destination := net.JoinHostPort(address.String(), strconv.Itoa(m.ContainerPort))
+	return append(rule, "-j", "DNAT", "--to-destination", destination)
+}
+
+// hostPortForwardRules accept the forwarded packets of a mapping's DNATed
+// connections, to the container and back
+func hostPortForwardRules(m PortMapping, address net.IP) [][]string {
+	protocol := mappingProtocol(m)
+	port := strconv.Itoa(m.ContainerPort)
+	accept := []string{"-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"}
+	return [][]string{
+		append([]string{"-d", address.String(), "-p", protocol, "--dport", port}, accept...),
+		append([]string{"-s", address.String(), "-p", protocol, "--sport", port}, accept...),
+	}
+}
+
+// ensureHostPortChain creates HostPortChain in both tables. The nat chain
+// gets locally addressed traffic, from other nodes and from the node
+// itself; the filter chain is jumped to first thing in FORWARD, ahead of
+// the policy and of rules that drop what they were not told about.
+func ensureHostPortChain(ipt *iptables.IPTables) error {
+	for _, table := range hostPortTables {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return fmt.Errorf("failed to list %s chains: %v", table, err)
+		}
+		exists := false
+		for _, chain := range chains {
+			exists = exists || chain == HostPortChain
+		}
+		if !exists {
+			if err := ipt.NewChain(table, HostPortChain); err != nil {
+				return fmt.Errorf("failed to create chain %s: %v", HostPortChain, err)
+			}
+		}
+	}
+	jump := []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", HostPortChain}
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		if err := ipt.AppendUnique("nat", chain, jump...); err != nil {
+			return fmt.Errorf("failed to add jump from %s to %s: %v", chain, HostPortChain, err)
+		}
+	}
+	exists, err := ipt.Exists("filter", "FORWARD", "-j", HostPortChain)
+	if err != nil {
+		return fmt.Errorf("failed to look for jump from FORWARD to %s: %v", HostPortChain, err)
+	}
+	if !exists {
+		if err := ipt.Insert("filter", "FORWARD", 1, "-j", HostPortChain); err != nil {
+			return fmt.Errorf("failed to add jump from FORWARD to %s: %v", HostPortChain, err)
+		}
+	}
+	return nil
+}
+
+// teardownHostPorts removes the container's chains of both families, if it
+// has any
+func teardownHostPorts(config *RainierConfig, containerID string) error {
+	chain := hostPortChain(config, containerID)
+	comment := utils.FormatComment(config.Name, containerID)
+	for _, version := range []string{"4", "6"} {
+		ipt, err := iptablesFor(version)
+		if err != nil {
+			return err
+		}
+		for _, table := range hostPortTables {
+			chains, err := ipt.ListChains(table)
+			if err != nil {
+				return fmt.Errorf("failed to list %s chains: %v", table, err)
+			}
+			for _, name := range chains {
+				if name != chain {
+					continue
+				}
+				jump := []string{"-m", "comment", "--comment", comment, "-j", chain}
+				if exists, err := ipt.Exists(table, HostPortChain, jump...); err == nil && exists {
+					if err := ipt.Delete(table, HostPortChain, jump...); err != nil {
+						return fmt.Errorf("failed to delete jump to %s: %v", chain, err)
+					}
+				}
+				if err := ipt.ClearChain(table, chain); err != nil {
+					return fmt.Errorf("failed to flush chain %s: %v", chain, err)
+				}
+				if err := ipt.DeleteChain(table, chain); err != nil {
+					return fmt.Errorf("failed to delete chain %s: %v", chain, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func iptablesFor(version string) (*iptables.IPTables, error) {
+	protocol := iptables.ProtocolIPv4
+	if version == "6" {
+		protocol = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run iptables for IPv%s: %v", version, err)
+	}
+	return ipt, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+func TestValidatePortMappings(t *testing.T) {
+	tests := []struct {
+		mapping PortMapping
+		valid   bool
+	}{
+		{PortMapping{HostPort: 8080, ContainerPort: 80}, true},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "UDP"}, true},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "sctp"}, true},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, HostIP: "fd00::1"}, true},
+		{PortMapping{HostPort: 0, ContainerPort: 80}, false},
+		{PortMapping{HostPort: 8080, ContainerPort: 65536}, false},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}, false},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, HostIP: "node"}, false},
+	}
+	for _, test := range tests {
+		if err := validatePortMappings([]PortMapping{test.mapping}); (err == nil) != test.valid {
+			t.Errorf("validatePortMappings(%+v) = %v, want valid %v", test.mapping, err, test.valid)
+		}
+	}
+}
+
+func TestHostPortRule(t *testing.T) {
+	tests := []struct {
+		mapping PortMapping
+		address string
+		want    []string
+	}{
+		{
+			PortMapping{HostPort: 8080, ContainerPort: 80},
+			"10.0.0.2",
+			[]string{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:80"},
+		},
+		{
+			PortMapping{HostPort: 53, ContainerPort: 5353, Protocol: "UDP", HostIP: "192.168.1.1"},
+			"10.0.0.2",
+			[]string{"-p", "udp", "--dport", "53", "-d", "192.168.1.1", "-j", "DNAT", "--to-destination", "10.0.0.2:5353"},
+		},
+		{
+			PortMapping{HostPort: 8080, ContainerPort: 80},
+			"fd00::2",
+			[]string{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "[fd00::2]:80"},
+		},
+	}
+	for _, test := range tests {
+		if got := hostPortRule(test.mapping, net.ParseIP(test.address)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("hostPortRule(%+v, %s) = %v, want %v", test.mapping, test.address, got, test.want)
+		}
+	}
+}
+
+func TestHostPortForwardRules(t *testing.T) {
+	got := hostPortForwardRules(PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "sctp"}, net.ParseIP("10.0.0.2"))
+	want := [][]string{
+		{"-d", "10.0.0.2", "-p", "sctp", "--dport", "80", "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"},
+		{"-s", "10.0.0.2", "-p", "sctp", "--sport", "80", "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hostPortForwardRules() = %v, want %v", got, want)
+	}
+}
+
+// A second address of a family must not replace the chain built for the
+// first one
+func TestHostPortRulesPerFamily(t *testing.T) {
+	result := &current.Result{}
+	for _, address := range []string{"10.0.0.2/24", "10.0.1.2/24", "fd00::2/64"} {
+		ip, ipnet, _ := net.ParseCIDR(address)
+		ipnet.IP = ip
+		result.IPs = append(result.IPs, &current.IPConfig{Address: *ipnet})
+	}
+	mappings := []PortMapping{{HostPort: 8080, ContainerPort: 80}, {HostPort: 53, ContainerPort: 53, Protocol: "udp", HostIP: "192.168.1.1"}}
+	families := hostPortRules(mappings, result)
+
+	want := [][]string{
+		hostPortRule(mappings[0], net.ParseIP("10.0.0.2")),
+		hostPortRule(mappings[1], net.ParseIP("10.0.0.2")),
+	}
+	if got := families["4"]["nat"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("IPv4 nat rules = %v, want %v", got, want)
+	}
+	want = [][]string{hostPortRule(mappings[0], net.ParseIP("fd00::2"))}
+	if got := families["6"]["nat"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("IPv6 nat rules = %v, want %v", got, want)
+	}
+	if got := len(families["4"]["filter"]); got != 4 {
+		t.Errorf("%d IPv4 filter rules, want 4", got)
+	}
+}
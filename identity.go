@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// Every container interface records whose it is in its external_ids, so
+// that anything looking at the bridge can tell pods apart: IPFIX collectors
+// by the ofport in obs_point_id, eBPF programs on the host veth and service
+// meshes by interface name or MAC. attached-mac and iface-id follow the
+// convention of OVN and other OVS integrations. Ofports and MACs are reused
+// once a pod is gone, so the mapping has to be looked up as it is used
+// rather than cached.
+var podIdentityKeys = []string{"rainier-container-id", "rainier-network", "rainier-ifname", "k8s-pod-namespace", "k8s-pod-name", "iface-id", "attached-mac"}
+
+func setPodIdentity(hostIfName string, key string, pod podArgs, mac string) error {
+	network, containerID, ifName := splitAttachmentKey(key)
+	identity := map[string]string{
+		"rainier-container-id": containerID,
+		"rainier-network":      network,
+		"rainier-ifname":       ifName,
+		"iface-id":             containerID,
+		"attached-mac":         mac,
+	}
+	namespace, hasNamespace := pod["K8S_POD_NAMESPACE"]
+	name, hasName := pod["K8S_POD_NAME"]
+	if hasNamespace && hasName {
+		identity["k8s-pod-namespace"] = namespace
+		identity["k8s-pod-name"] = name
+		identity["iface-id"] = namespace + "/" + name
+	}
+
+	args := []string{"set", "interface", hostIfName}
+	for _, key := range podIdentityKeys {
+		if value := identity[key]; value != "" {
+			args = append(args, fmt.Sprintf("external_ids:%s=%q", key, value))
+		}
+	}
+	if _, err := vsctl(args...); err != nil {
+		return fmt.Errorf("Failed to record pod identity on interface %s. Error = %s", hostIfName, err)
+	}
+	return nil
+}
+
+// attachedInterface returns the host interface of a container's attachment,
+// or "" when it has none. With ovsdbState, an attachment the state file lost
+// is looked up by its identity on the network's interfaces, at the cost of
+// asking OVSDB about containers that were never attached. Ports that predate
+// the network or interface name in their identity match any.
+func attachedInterface(config *RainierConfig, containerID string, ifName string) (string, error) {
+	readHostInterfacesFromFile()
+	if name, ok := hostInterfaces[attachmentKey(config.Name, containerID, ifName)].(string); ok {
+		return name, nil
+	}
+	if !config.OvsdbState {
+		return "", nil
+	}
+	out, err := vsctl("--bare", "--columns=name", "find", "interface", fmt.Sprintf("external_ids:rainier-container-id=%q", containerID))
+	if err != nil {
+		return "", err
+	}
+	for _, name := range strings.Fields(out) {
+		network := interfaceExternalID(name, "rainier-network")
+		recorded := interfaceExternalID(name, "rainier-ifname")
+		if (network == "" || network == config.Name) && (recorded == "" || recorded == ifName) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// containerMAC returns the MAC of the container interface of a result
+func containerMAC(result *current.Result) string {
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" {
+			return iface.Mac
+		}
+	}
+	return ""
+}
+
+type podIdentity struct {
+	Interface   string   `json:"interface"`
+	Ofport      int      `json:"ofport"`
+	MAC         string   `json:"mac"`
+	Addresses   []string `json:"addresses"`
+	ContainerID string   `json:"containerID"`
+	Namespace   string   `json:"namespace,omitempty"`
+	Name        string   `json:"name,omitempty"`
+}
+
+// cmdIdentities lists the attached containers by port, MAC and address, for
+// external dataplanes that enforce identity-aware policy on top of rainier:
+//
+//	rainier identities [-json]
+func cmdIdentities(args []string) error {
+	flags := flag.NewFlagSet("identities", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	readHostInterfacesFromFile()
+	readAddressesFromFile()
+	identities := []podIdentity{}
+	for key, hostIfName := range hostInterfaces {
+		identity := podIdentity{
+			Interface:   hostIfName.(string),
+			ContainerID: keyContainerID(key),
+			Addresses:   addresses[key],
+		}
+		ofport, err := getOfport(identity.Interface)
+		if err != nil {
+			// Not a port, e.g. a host device
+			continue
+		}
+		identity.Ofport = ofport
+		identity.MAC = interfaceExternalID(identity.Interface, "attached-mac")
+		identity.Namespace = interfaceExternalID(identity.Interface, "k8s-pod-namespace")
+		identity.Name = interfaceExternalID(identity.Interface, "k8s-pod-name")
+		identities = append(identities, identity)
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Ofport < identities[j].Ofport })
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(identities)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFPORT\tINTERFACE\tMAC\tADDRESSES\tCONTAINER\tPOD")
+	for _, identity := range identities {
+		pod := ""
+		if identity.Name != "" {
+			pod = identity.Namespace + "/" + identity.Name
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", identity.Ofport, identity.Interface, identity.MAC,
+			strings.Join(identity.Addresses, ","), shortID(identity.ContainerID), pod)
+	}
+	return w.Flush()
+}
+
+func interfaceExternalID(ifName string, key string) string {
+	value, err := vsctl("--if-exists", "get", "interface", ifName, "external_ids:"+key)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(value, `"`)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const MaxAlternateIfNames = 100
+
+// validateIfName applies the kernel's rules for interface names, so that a
+// bad CNI_IFNAME fails with a clear error rather than an EINVAL from deep
+// within netlink
+func validateIfName(name string) error {
+	if name == "" || len(name) > MaxIfNameLen {
+		return fmt.Errorf("interface name %q must be 1-%d characters", name, MaxIfNameLen)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("interface name %q is not allowed", name)
+	}
+	if strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("interface name %q must not contain '/', ':' or whitespace", name)
+	}
+	return nil
+}
+
+// validateIfNamePrefix leaves room for the number appended to the prefix
+func validateIfNamePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if err := validateIfName(prefix + strconv.Itoa(MaxAlternateIfNames)); err != nil {
+		return fmt.Errorf("invalid ifNamePrefix: %v", err)
+	}
+	return nil
+}
+
+// setupContainerVeth creates the veth pair with ifName in the container. When
+// ifName is taken, e.g. by another attachment, and the network has a
+// prefix, the first free name of prefix1, prefix2, ... is used instead. A
+// name taken between the lookup and the creation is skipped as well. Must
+// run in the container's namespace.
+func setupContainerVeth(ifName string, prefix string, mtu int, hostNS ns.NetNS) (net.Interface, net.Interface, error) {
+	candidates := []string{ifName}
+	if prefix != "" {
+		for i := 1; i < MaxAlternateIfNames; i++ {
+			candidates = append(candidates, prefix+strconv.Itoa(i))
+		}
+	}
+	for _, name := range candidates {
+		if _, err := netlink.LinkByName(name); err == nil {
+			continue
+		}
+		hostVeth, containerVeth, err := ip.SetupVeth(name, mtu, "", hostNS)
+		if err != nil {
+			if _, taken := netlink.LinkByName(name); taken == nil && prefix != "" {
+				continue
+			}
+		}
+		return hostVeth, containerVeth, err
+	}
+	if prefix == "" {
+		return net.Interface{}, net.Interface{}, fmt.Errorf("interface %s already exists in the container", ifName)
+	}
+	return net.Interface{}, net.Interface{}, fmt.Errorf("interface %s and every %sN up to %d already exist in the container", ifName, prefix, MaxAlternateIfNames-1)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestValidateIfName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"eth0", true},
+		{"net1.100", true},
+		{"abcdefghijklmno", true},
+		{"", false},
+		{"abcdefghijklmnop", false},
+		{".", false},
+		{"..", false},
+		{"eth/0", false},
+		{"eth0:1", false},
+		{"eth 0", false},
+	}
+	for _, test := range tests {
+		if err := validateIfName(test.name); (err == nil) != test.valid {
+			t.Errorf("validateIfName(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
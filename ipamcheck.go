@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+)
+
+const AddressJson = StateDir + "/addresses.json"
+
+// Addresses handed to containers on this node, used to catch an IPAM plugin
+// that returns an address which is still in use
+var addresses = make(map[string][]string)
+
+// ipamRange is the part of a host-local style IPAM configuration needed to
+// tell whether a returned address is one that was asked for
+type ipamRange struct {
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+}
+
+type ipamRangeConfig struct {
+	IPAM struct {
+		ipamRange
+		Ranges [][]ipamRange `json:"ranges"`
+	} `json:"ipam"`
+}
+
+func validateIpamType(ipamType string, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, t := range allowed {
+		if t == ipamType {
+			return nil
+		}
+	}
+	return fmt.Errorf("IPAM plugin %q is not in allowedIpamTypes %v", ipamType, allowed)
+}
+
+// execIpamAdd runs the IPAM plugin and rejects results that must not reach
+// the dataplane, including ones without the addresses the runtime asked for
+// with the "ips" capability. Rejected addresses are released again. Networks
+// whose addresses all come from SLAAC may have no IPAM; without IPAM the
+// addresses asked for are used as they are.
+func execIpamAdd(config *RainierConfig, key string, stdinData []byte) (*current.Result, error) {
+	requested := config.RuntimeConfig.IPs
+	if config.IPAM.Type == "" && len(requested) > 0 {
+		result := staticResult(requested)
+		if err := validateIpamResult(key, stdinData, result); err != nil {
+			return nil, fmt.Errorf("requested addresses: %v", err)
+		}
+		return result, nil
+	}
+	if config.IPAM.Type == "" && config.Slaac != nil {
+		return &current.Result{CNIVersion: current.ImplementedSpecVersion}, nil
+	}
+	if err := validateIpamType(config.IPAM.Type, config.AllowedIpamTypes); err != nil {
+		return nil, err
+	}
+	r, err := ipam.ExecAdd(config.IPAM.Type, stdinData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert IPAM result to current Result type
+	result, err := current.NewResultFromResult(r)
+	if err == nil {
+		err = validateIpamResult(key, stdinData, result)
+	}
+	if err == nil {
+		err = checkRequestedIPs(requested, result)
+	}
+	if err != nil {
+		ipam.ExecDel(config.IPAM.Type, stdinData)
+		return nil, fmt.Errorf("IPAM plugin %s returned an invalid result: %v", config.IPAM.Type, err)
+	}
+	return result, nil
+}
+
+func validateStaticIPs(ips []string) error {
+	for _, address := range ips {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("invalid requested address %q, want an address with prefix length", address)
+		}
+	}
+	return nil
+}
+
+// staticResult returns the requested addresses as a result of their own
+func staticResult(ips []string) *current.Result {
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	for _, address := range ips {
+		ip, ipnet, _ := net.ParseCIDR(address)
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: net.IPNet{IP: ip, Mask: ipnet.Mask},
+		})
+	}
+	return result
+}
+
+// checkRequestedIPs fails when IPAM left out a requested address, e.g. as
+// the plugin does not support the "ips" capability
+func checkRequestedIPs(ips []string, result *current.Result) error {
+	for _, address := range ips {
+		ip, _, _ := net.ParseCIDR(address)
+		if !resultHasIP(result, ip) {
+			return fmt.Errorf("requested address %s not assigned, does the plugin support the ips capability?", ip)
+		}
+	}
+	return nil
+}
+
+func validateIpamResult(key string, stdinData []byte, result *current.Result) error {
+	if len(result.IPs) == 0 {
+		return fmt.Errorf("no IP address")
+	}
+
+	ranges := []ipamRange{}
+	rangeConfig := &ipamRangeConfig{}
+	if err := json.Unmarshal(stdinData, rangeConfig); err == nil {
+		if rangeConfig.IPAM.Subnet != "" {
+			ranges = append(ranges, rangeConfig.IPAM.ipamRange)
+		}
+		for _, set := range rangeConfig.IPAM.Ranges {
+			ranges = append(ranges, set...)
+		}
+	}
+
+	readAddressesFromFile()
+	seen := make(map[string]bool)
+	for _, ipc := range result.IPs {
+		address := ipc.Address.IP
+		if seen[address.String()] {
+			return fmt.Errorf("address %s is returned twice", address)
+		}
+		seen[address.String()] = true
+		if len(ranges) > 0 && !inRanges(address, ranges) {
+			return fmt.Errorf("address %s is outside of the configured ranges", address)
+		}
+		if ipc.Gateway != nil {
+			if ipc.Gateway.Equal(address) {
+				return fmt.Errorf("gateway %s is the container's own address", ipc.Gateway)
+			}
+			if !ipc.Address.Contains(ipc.Gateway) {
+				return fmt.Errorf("gateway %s is outside of %s", ipc.Gateway, ipc.Address.String())
+			}
+		}
+		for owner, owned := range addresses {
+			if owner == key {
+				continue
+			}
+			for _, a := range owned {
+				if a == address.String() {
+					return fmt.Errorf("address %s is still used by container %s", address, keyContainerID(owner))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func inRanges(address net.IP, ranges []ipamRange) bool {
+	for _, r := range ranges {
+		_, subnet, err := net.ParseCIDR(r.Subnet)
+		if err != nil || !subnet.Contains(address) {
+			continue
+		}
+		if start := net.ParseIP(r.RangeStart); start != nil && bytes.Compare(address.To16(), start.To16()) < 0 {
+			continue
+		}
+		if end := net.ParseIP(r.RangeEnd); end != nil && bytes.Compare(address.To16(), end.To16()) > 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func recordAddresses(key string, result *current.Result) error {
+	owned := []string{}
+	for _, ipc := range result.IPs {
+		owned = append(owned, ipc.Address.IP.String())
+	}
+	return updateState(AddressJson, &addresses, func() error {
+		addresses[key] = owned
+		return nil
+	})
+}
+
+func forgetAddresses(key string) error {
+	return updateState(AddressJson, &addresses, func() error {
+		delete(addresses, key)
+		return nil
+	})
+}
+
+func readAddressesFromFile() error {
+	return readState(AddressJson, &addresses)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+)
+
+// In IPv6-only networks containers get no IPv4 at all. Routes come from
+// rainier rather than from router advertisements, and the bridge drops ARP
+// and router advertisements sent by containers so that no container can pose
+// as the network's router. IPv4 sent anyway is dropped too. The container
+// interface keeps resolving neighbors, which IPv6 does with neighbor
+// discovery.
+//
+// With Slaac, addresses and the default route come from the network's
+// router instead: the container accepts router advertisements, IPAM is
+// optional, and ADD waits for the SLAAC addresses to report them.
+
+const DefaultSlaacTimeout = 10
+
+type Slaac struct {
+	Timeout int `json:"timeout"`
+}
+
+func validateSlaac(config *RainierConfig) error {
+	if config.Slaac == nil {
+		return nil
+	}
+	if !config.IPv6Only {
+		return fmt.Errorf("slaac needs ipv6Only")
+	}
+	if config.Mode == ModePtp {
+		return fmt.Errorf("slaac cannot be used in ptp mode")
+	}
+	if config.Slaac.Timeout < 0 {
+		return fmt.Errorf("invalid slaac timeout %d", config.Slaac.Timeout)
+	}
+	if config.Slaac.Timeout == 0 {
+		config.Slaac.Timeout = DefaultSlaacTimeout
+	}
+	return nil
+}
+
+// ipv6OnlyResult rejects IPv4 addresses and makes sure the container gets a
+// default route, unless router advertisements provide it. IPAM may hand out
+// a link-local gateway; the route is then bound to the container interface.
+func ipv6OnlyResult(result *current.Result, slaac bool) error {
+	for _, ipc := range result.IPs {
+		if ipVersion(ipc.Address.IP) != "6" {
+			return fmt.Errorf("IPAM returned IPv4 address %s on an IPv6-only network", ipc.Address.String())
+		}
+	}
+	if slaac {
+		return nil
+	}
+	for _, route := range result.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			return nil
+		}
+	}
+	_, dst, _ := net.ParseCIDR("::/0")
+	result.Routes = append(result.Routes, &types.Route{Dst: *dst})
+	return nil
+}
+
+// configureIPv6Only must run in the container's namespace before the
+// interface is configured
+func configureIPv6Only(config *RainierConfig, ifName string) error {
+	acceptRA, defaultRouter := "0", "0"
+	if config.Slaac != nil {
+		acceptRA = "1"
+		if isPrimaryNetwork(config) {
+			defaultRouter = "1"
+		}
+	}
+	for _, sysctl := range []struct{ name, value string }{
+		{"disable_ipv6", "0"},
+		{"accept_ra", acceptRA},
+		{"accept_ra_defrtr", defaultRouter},
+		{"autoconf", acceptRA},
+	} {
+		path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/%s", ifName, sysctl.name)
+		if err := ioutil.WriteFile(path, []byte(sysctl.value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func ipv6OnlyPort(pipeline *portPipeline) {
+	pipeline.drop(featureIPv6Only, "ip")
+	pipeline.drop(featureIPv6Only, "arp")
+	pipeline.drop(featureIPv6Only, "icmp6,icmp_type=134")
+}
+
+// waitForSlaac waits for the container interface to autoconfigure global
+// addresses and adds them to the result, with the router the default route
+// points at as gateway. Must run in the container's namespace.
+func waitForSlaac(ifName string, timeout int, result *current.Result) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to find %s in container: %v", ifName, err)
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of %s: %v", ifName, err)
+		}
+		slaac := []netlink.Addr{}
+		for _, addr := range addrs {
+			if addr.IP.IsGlobalUnicast() && addr.Flags&syscall.IFA_F_TENTATIVE == 0 && !resultHasIP(result, addr.IP) {
+				slaac = append(slaac, addr)
+			}
+		}
+		if len(slaac) > 0 {
+			gateway := slaacGateway(link)
+			for _, addr := range slaac {
+				result.IPs = append(result.IPs, &current.IPConfig{
+					Interface: current.Int(containerIndex(result, ifName)),
+					Address:   *addr.IPNet,
+					Gateway:   gateway,
+				})
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no SLAAC address on %s within %ds, is a router advertising a prefix?", ifName, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func resultHasIP(result *current.Result, ip net.IP) bool {
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// slaacGateway returns the router of the default route learned from router
+// advertisements, nil if there is none yet
+func slaacGateway(link netlink.Link) net.IP {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil
+	}
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			return route.Gw
+		}
+	}
+	return nil
+}
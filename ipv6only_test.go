@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+func ipv6OnlyTestResult(addresses ...string) *current.Result {
+	result := &current.Result{}
+	for _, address := range addresses {
+		ip, ipnet, _ := net.ParseCIDR(address)
+		ipnet.IP = ip
+		result.IPs = append(result.IPs, &current.IPConfig{Address: *ipnet})
+	}
+	return result
+}
+
+func TestIpv6OnlyResult(t *testing.T) {
+	_, defaultRoute, _ := net.ParseCIDR("::/0")
+	_, subnet, _ := net.ParseCIDR("fd00:1::/64")
+
+	result := ipv6OnlyTestResult("fd00::2/64")
+	if err := ipv6OnlyResult(result, false); err != nil {
+		t.Fatalf("ipv6OnlyResult() = %v", err)
+	}
+	if len(result.Routes) != 1 || result.Routes[0].Dst.String() != "::/0" {
+		t.Errorf("ipv6OnlyResult() without a default route gave routes %v, want ::/0", result.Routes)
+	}
+
+	result = ipv6OnlyTestResult("fd00::2/64")
+	result.Routes = []*types.Route{{Dst: *subnet}, {Dst: *defaultRoute, GW: net.ParseIP("fe80::1")}}
+	if err := ipv6OnlyResult(result, false); err != nil || len(result.Routes) != 2 {
+		t.Errorf("ipv6OnlyResult() with a default route = %v, routes %v, want them unchanged", err, result.Routes)
+	}
+
+	result = ipv6OnlyTestResult("fd00::2/64")
+	if err := ipv6OnlyResult(result, true); err != nil || len(result.Routes) != 0 {
+		t.Errorf("ipv6OnlyResult() with SLAAC = %v, routes %v, want none added", err, result.Routes)
+	}
+
+	result = ipv6OnlyTestResult("10.0.0.2/24", "fd00::2/64")
+	if err := ipv6OnlyResult(result, false); err == nil {
+		t.Errorf("ipv6OnlyResult() with an IPv4 address succeeded")
+	}
+}
+
+func TestValidateSlaac(t *testing.T) {
+	tests := []struct {
+		config *RainierConfig
+		valid  bool
+	}{
+		{&RainierConfig{}, true},
+		{&RainierConfig{IPv6Only: true, Slaac: &Slaac{}}, true},
+		{&RainierConfig{Slaac: &Slaac{}}, false},
+		{&RainierConfig{IPv6Only: true, Mode: ModePtp, Slaac: &Slaac{}}, false},
+		{&RainierConfig{IPv6Only: true, Slaac: &Slaac{Timeout: -1}}, false},
+	}
+	for _, test := range tests {
+		if err := validateSlaac(test.config); (err == nil) != test.valid {
+			t.Errorf("validateSlaac(%+v) = %v, want valid %v", test.config.Slaac, err, test.valid)
+		}
+	}
+
+	config := &RainierConfig{IPv6Only: true, Slaac: &Slaac{}}
+	validateSlaac(config)
+	if config.Slaac.Timeout != DefaultSlaacTimeout {
+		t.Errorf("validateSlaac() left timeout %d, want the default %d", config.Slaac.Timeout, DefaultSlaacTimeout)
+	}
+}
+
+// fakeIpam writes an IPAM plugin that hands out result on ADD and releases
+// nothing on DEL
+func fakeIpam(t *testing.T, result string) string {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nif [ \"$CNI_COMMAND\" = ADD ]; then echo '" + result + "'; fi\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "rainier-test-ipam"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// ADD and DEL an IPv6-only container in macvlan mode, which needs no OVS,
+// between network namespaces standing in for the node and the container.
+// Needs root, and keeps its state under StateDir as ADD does on a node.
+func TestIpv6OnlyAddDel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root for network namespaces")
+	}
+	hostNS, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer testutils.UnmountNS(hostNS)
+	defer hostNS.Close()
+	containerNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testutils.UnmountNS(containerNS)
+	defer containerNS.Close()
+
+	// The network's router sits at the other end of the uplink
+	err = hostNS.Do(func(ns.NetNS) error {
+		uplink := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}, PeerName: "router0"}
+		if err := netlink.LinkAdd(uplink); err != nil {
+			return err
+		}
+		router, err := netlink.LinkByName("router0")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("fd00:6::1/64")
+		addr.Flags = syscall.IFA_F_NODAD
+		if err := netlink.AddrAdd(router, addr); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(router); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(uplink)
+	})
+	if err != nil {
+		t.Fatalf("failed to set up the uplink: %v", err)
+	}
+
+	ipamDir := fakeIpam(t, `{"cniVersion": "1.0.0", "ips": [{"address": "fd00:6::10/64", "gateway": "fd00:6::1"}]}`)
+	t.Setenv("PATH", ipamDir+":"+os.Getenv("PATH"))
+	conf := []byte(`{
+		"cniVersion": "1.0.0",
+		"name": "rainier-test-ipv6only",
+		"type": "rainier",
+		"mode": "macvlan",
+		"uplink": "uplink0",
+		"ipv6Only": true,
+		"ipam": {"type": "rainier-test-ipam"}
+	}`)
+	args := &skel.CmdArgs{
+		ContainerID: "rainier-test-ipv6only",
+		Netns:       containerNS.Path(),
+		IfName:      "eth0",
+		StdinData:   conf,
+	}
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		_, _, err := testutils.CmdAddWithArgs(args, func() error { return cmdAdd(args) })
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	err = containerNS.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		if link.Attrs().RawFlags&syscall.IFF_NOARP != 0 {
+			t.Errorf("eth0 has NOARP set, which breaks neighbor discovery")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CHECK resolves the gateway with neighbor discovery
+	err = hostNS.Do(func(ns.NetNS) error {
+		return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+	})
+	if err != nil {
+		t.Errorf("CHECK failed: %v", err)
+	}
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+	})
+	if err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	err = containerNS.Do(func(ns.NetNS) error {
+		if _, err := netlink.LinkByName("eth0"); err == nil {
+			t.Errorf("eth0 is left in the container after DEL")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Runtimes and KubeVirt ask for the container interface's MAC through the
+// "mac" capability, Multus through CNI_ARGS MAC or args.cni mac. A VM behind
+// the pod interface keeps its MAC this way across restarts and migrations,
+// and so do appliances licensed to a MAC or hosts with a DHCP reservation.
+// The MAC is set before the interface gets its addresses, so that neighbors
+// never learn another one, and reported in the result.
+type RuntimeConfig struct {
+	Mac          string        `json:"mac"`
+	Vlan         int           `json:"vlan"`
+	PortMappings []PortMapping `json:"portMappings"`
+	Bandwidth    *Bandwidth    `json:"bandwidth"`
+	IPs          []string      `json:"ips"`
+}
+
+func requestedMAC(config *RainierConfig, pod podArgs) (net.HardwareAddr, error) {
+	value := config.RuntimeConfig.Mac
+	for _, key := range []string{"mac", "MAC"} {
+		if value == "" {
+			value = pod[key]
+		}
+	}
+	if value == "" {
+		return nil, nil
+	}
+	mac, err := net.ParseMAC(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid requested MAC %q: %v", value, err)
+	}
+	if len(mac) != 6 || mac[0]&0x01 != 0 || bytes.Equal(mac, make(net.HardwareAddr, 6)) {
+		return nil, fmt.Errorf("requested MAC %s is not a unicast Ethernet address", mac)
+	}
+	return mac, nil
+}
+
+// checkMACInUse fails when another container's port on the bridge was
+// given the MAC, which would split the traffic of both between them. Retries
+// of the container's own ADD may find its port with the MAC already.
+func checkMACInUse(mac net.HardwareAddr, containerID string) error {
+	out, err := vsctl("--bare", "--columns=name", "find", "interface", fmt.Sprintf("external_ids:attached-mac=%q", mac.String()))
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Fields(out) {
+		if owner := interfaceExternalID(name, "rainier-container-id"); owner != containerID {
+			return fmt.Errorf("requested MAC %s is in use by container %s", mac, owner)
+		}
+	}
+	return nil
+}
+
+// setLinkMAC must run in the namespace of the link
+func setLinkMAC(ifName string, mac net.HardwareAddr) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %v", ifName, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %s down: %v", ifName, err)
+	}
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("failed to set MAC %s on %s: %v", mac, ifName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %s up: %v", ifName, err)
+	}
+	return nil
+}
+
+// containerVethName finds the container end of the host veth by its peer
+// index, since KubeVirt renames the interface rainier created (eth0 becomes
+// eth0-nic) and puts a dummy or a bridge in its place. ifName is returned
+// when the veth cannot be found that way.
+func containerVethName(netns ns.NetNS, hostIfName string, ifName string) string {
+	hostLink, err := netlink.LinkByName(hostIfName)
+	if err != nil {
+		return ifName
+	}
+	name := ifName
+	netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByIndex(hostLink.Attrs().ParentIndex)
+		if err == nil && link.Type() == "veth" {
+			name = link.Attrs().Name
+		}
+		return nil
+	})
+	return name
+}
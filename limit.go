@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const ConcurrencyQueueLock = StateDir + "/queue.lock"
+const ConcurrencySlotLock = StateDir + "/slot-%d.lock"
+const MaxConcurrencyWait = 60
+
+// Every plugin invocation is a new process, so the limit on concurrent
+// dataplane changes is a set of lock files: one per slot, plus a queue lock
+// that waiters line up on so that freed slots go to them in roughly the
+// order they arrived. Locks die with their process, so a crashed plugin
+// never leaks a slot. They live in StateDir rather than /tmp, where other
+// users could create or hold them.
+
+func lockFile(path string, how int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func acquireSlot(limit int) (func(), error) {
+	if limit == 0 {
+		return func() {}, nil
+	}
+	deadline := time.Now().Add(MaxConcurrencyWait * time.Second)
+
+	// Get in line
+	type locked struct {
+		f   *os.File
+		err error
+	}
+	queued := make(chan locked, 1)
+	go func() {
+		f, err := lockFile(ConcurrencyQueueLock, syscall.LOCK_EX)
+		queued <- locked{f, err}
+	}()
+	var queue locked
+	select {
+	case queue = <-queued:
+	case <-time.After(time.Until(deadline)):
+		return nil, tooBusy(limit)
+	}
+	if queue.err != nil {
+		return nil, fmt.Errorf("Failed to lock %s. Error = %s", ConcurrencyQueueLock, queue.err)
+	}
+	defer queue.f.Close()
+
+	// Wait at the head of the line for a free slot
+	for {
+		for i := 0; i < limit; i++ {
+			path := fmt.Sprintf(ConcurrencySlotLock, i)
+			slot, err := lockFile(path, syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				return func() { slot.Close() }, nil
+			}
+			if err != syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("Failed to lock %s. Error = %s", path, err)
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, tooBusy(limit)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func tooBusy(limit int) error {
+	return &types.Error{
+		Code:    ErrTryAgainLater,
+		Msg:     "too many concurrent network operations on this node, try again later",
+		Details: fmt.Sprintf("no free slot out of %d within %ds", limit, MaxConcurrencyWait),
+	}
+}
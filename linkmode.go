@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const ModeMacvlan = "macvlan"
+const ModeIpvlan = "ipvlan"
+
+// macvlan and ipvlan modes attach containers directly to the uplink, for
+// nodes without OVS. They use the same configuration, IPAM handling and
+// state as the OVS modes; linkMode picks the macvlan or ipvlan mode.
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"":         netlink.MACVLAN_MODE_BRIDGE,
+	"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+	"private":  netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":     netlink.MACVLAN_MODE_VEPA,
+	"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+}
+
+var ipvlanModes = map[string]netlink.IPVlanMode{
+	"":   netlink.IPVLAN_MODE_L2,
+	"l2": netlink.IPVLAN_MODE_L2,
+	"l3": netlink.IPVLAN_MODE_L3,
+}
+
+func validateLinkMode(config *RainierConfig) error {
+	if config.Uplink == "" {
+		return fmt.Errorf("%s mode needs an uplink", config.Mode)
+	}
+	if config.Mode == ModeMacvlan {
+		if _, ok := macvlanModes[config.LinkMode]; !ok {
+			return fmt.Errorf("invalid macvlan linkMode %q", config.LinkMode)
+		}
+	} else if _, ok := ipvlanModes[config.LinkMode]; !ok {
+		return fmt.Errorf("invalid ipvlan linkMode %q", config.LinkMode)
+	}
+	return nil
+}
+
+func cmdAddLink(config *RainierConfig, args *skel.CmdArgs, report *opReport) error {
+	// Get name space
+	if err := report.step("openNetns"); err != nil {
+		return err
+	}
+	netns, err := openNetns(args.Netns)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	// Create the link on the uplink, straight in the container
+	if err := report.step("createLink"); err != nil {
+		return err
+	}
+	pod := loadPodArgs(config, args.Args)
+	mac, err := requestedMAC(config, pod)
+	if err != nil {
+		return err
+	}
+	if mac != nil && config.Mode != ModeMacvlan {
+		return fmt.Errorf("a MAC can only be requested in macvlan mode")
+	}
+	containerInterface, err := createLink(config, netns, args.IfName)
+	if err != nil {
+		return err
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		if mac == nil {
+			return nil
+		}
+		containerInterface.Mac = mac.String()
+		return setLinkMAC(args.IfName, mac)
+	})
+	if err != nil {
+		return err
+	}
+
+	return configureAttachment(config, args, report, netns, pod, containerInterface)
+}
+
+func createLink(config *RainierConfig, netns ns.NetNS, ifName string) (*current.Interface, error) {
+	parent, err := netlink.LinkByName(config.Uplink)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find uplink %s: %v", config.Uplink, err)
+	}
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+	attrs := netlink.LinkAttrs{
+		Name:        tmpName,
+		ParentIndex: parent.Attrs().Index,
+		MTU:         parent.Attrs().MTU,
+		Namespace:   netlink.NsFd(int(netns.Fd())),
+	}
+	var link netlink.Link = &netlink.IPVlan{LinkAttrs: attrs, Mode: ipvlanModes[config.LinkMode]}
+	if config.Mode == ModeMacvlan {
+		link = &netlink.Macvlan{LinkAttrs: attrs, Mode: macvlanModes[config.LinkMode]}
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s on %s: %v", config.Mode, config.Uplink, err)
+	}
+
+	iface := &current.Interface{Name: ifName, Sandbox: netns.Path()}
+	err = netns.Do(func(_ ns.NetNS) error {
+		if err := renameLink(tmpName, ifName); err != nil {
+			if link, err := netlink.LinkByName(tmpName); err == nil {
+				netlink.LinkDel(link)
+			}
+			return err
+		}
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %s in container: %v", ifName, err)
+		}
+		iface.Mac = link.Attrs().HardwareAddr.String()
+		return nil
+	})
+	return iface, err
+}
+
+// deleteLink removes the container's link; it is already gone if the
+// container's namespace is. An interface of that name but of another kind
+// is not rainier's, e.g. when a rolled back ADD failed before creating the
+// link.
+func deleteLink(config *RainierConfig, args *skel.CmdArgs) error {
+	if args.Netns == "" {
+		return nil
+	}
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil || link.Type() != config.Mode {
+			return nil
+		}
+		return netlink.LinkDel(link)
+	})
+	if _, gone := err.(ns.NSPathNotExistErr); err != nil && !gone {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const MaintenanceFile = "/tmp/rainier-maintenance"
+
+// While MaintenanceFile exists the node's dataplane is frozen: ADD and DEL
+// fail with a retryable error before touching anything and CHECK reports
+// without repairing, so ports and flows stay exactly as they are while an
+// operator debugs them. The file holds why and since when.
+func maintenanceMode() error {
+	reason, err := ioutil.ReadFile(MaintenanceFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return &types.Error{
+		Code:    ErrTryAgainLater,
+		Msg:     "node is in maintenance, try again later",
+		Details: strings.TrimSpace(string(reason)),
+	}
+}
+
+// cmdMaintenance turns maintenance mode on or off, or shows whether it is on:
+//
+//	rainier maintenance [on [-reason text] | off]
+func cmdMaintenance(args []string) error {
+	if len(args) == 0 {
+		if err := maintenanceMode(); err != nil {
+			fmt.Printf("on: %s\n", err.(*types.Error).Details)
+		} else {
+			fmt.Println("off")
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "on":
+		flags := flag.NewFlagSet("maintenance on", flag.ContinueOnError)
+		reason := flags.String("reason", "", "why, shown in the errors ADD and DEL return")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		text := fmt.Sprintf("since %s", time.Now().Format(time.RFC3339))
+		if *reason != "" {
+			text = fmt.Sprintf("%s, %s", *reason, text)
+		}
+		if err := ioutil.WriteFile(MaintenanceFile, []byte(text+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", MaintenanceFile, err)
+		}
+		return nil
+	case "off":
+		if err := os.Remove(MaintenanceFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", MaintenanceFile, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("usage: rainier maintenance [on [-reason text] | off]")
+}
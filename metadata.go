@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const DefaultMetadataHookTimeout = 5
+const MaxMetadataOutput = 64 << 10
+
+// Metadata hooks tag container ports with external_ids of the operator's
+// choosing, e.g. a cost center or environment looked up from the pod, for
+// flow collectors and billing systems that read them off the bridge. A hook
+// is an executable that gets the pod on stdin as JSON and prints a JSON
+// object of string keys and values. Keys of rainier's own identity are not
+// theirs to set. A hook that fails fails ADD, unless it is optional.
+type MetadataHook struct {
+	Path     string `json:"path"`
+	Timeout  int    `json:"timeout"`
+	Optional bool   `json:"optional"`
+}
+
+// metadataRequest is what hooks read on stdin
+type metadataRequest struct {
+	ContainerID string            `json:"containerID"`
+	Network     string            `json:"network"`
+	Interface   string            `json:"interface"`
+	MAC         string            `json:"mac"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Args        map[string]string `json:"args"`
+}
+
+func validateMetadataHooks(hooks []MetadataHook) error {
+	for i := range hooks {
+		if !strings.HasPrefix(hooks[i].Path, "/") {
+			return fmt.Errorf("metadata hook %q must be an absolute path", hooks[i].Path)
+		}
+		if hooks[i].Timeout < 0 {
+			return fmt.Errorf("invalid metadata hook timeout %d", hooks[i].Timeout)
+		}
+		if hooks[i].Timeout == 0 {
+			hooks[i].Timeout = DefaultMetadataHookTimeout
+		}
+	}
+	return nil
+}
+
+// setPortMetadata runs the hooks in order and sets what they return on the
+// port's interface; later hooks win over earlier ones
+func setPortMetadata(config *RainierConfig, hostIfName string, containerID string, pod podArgs, mac string) error {
+	request := metadataRequest{
+		ContainerID: containerID,
+		Network:     config.Name,
+		Interface:   hostIfName,
+		MAC:         mac,
+		Namespace:   pod["K8S_POD_NAMESPACE"],
+		Name:        pod["K8S_POD_NAME"],
+		Args:        pod,
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata request: %v", err)
+	}
+
+	metadata := make(map[string]string)
+	for _, hook := range config.MetadataHooks {
+		values, err := runMetadataHook(hook, input)
+		if err != nil {
+			if hook.Optional {
+				continue
+			}
+			return err
+		}
+		for key, value := range values {
+			metadata[key] = value
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	keys := []string{}
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{"set", "interface", hostIfName}
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("external_ids:%s=%q", key, metadata[key]))
+	}
+	if _, err := vsctl(args...); err != nil {
+		return fmt.Errorf("Failed to set metadata on interface %s. Error = %s", hostIfName, err)
+	}
+	return nil
+}
+
+// runMetadataHook runs a hook in its own process group, killed with
+// everything it spawned when it runs out of time
+func runMetadataHook(hook MetadataHook, input []byte) (map[string]string, error) {
+	timeout := withinDeadline(time.Duration(hook.Timeout) * time.Second)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("metadata hook %s not run, deadline exceeded", hook.Path)
+	}
+	c := exec.Command(hook.Path)
+	c.Stdin = bytes.NewReader(input)
+	out := &cappedBuffer{limit: MaxMetadataOutput}
+	stderr := &cappedBuffer{limit: MaxMetadataOutput}
+	c.Stdout = out
+	c.Stderr = stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run metadata hook %s: %v", hook.Path, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("metadata hook %s failed: %v: %s", hook.Path, err, strings.TrimSpace(stderr.String()))
+		}
+	case <-timer.C:
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, fmt.Errorf("metadata hook %s timed out after %s", hook.Path, timeout)
+	}
+
+	values := make(map[string]string)
+	if err := json.Unmarshal(out.Bytes(), &values); err != nil {
+		return nil, fmt.Errorf("metadata hook %s printed invalid JSON: %v", hook.Path, err)
+	}
+	for key := range values {
+		if key == "" || strings.HasPrefix(key, "rainier-") || reservedIdentityKey(key) {
+			return nil, fmt.Errorf("metadata hook %s may not set external_ids key %q", hook.Path, key)
+		}
+	}
+	return values, nil
+}
+
+func reservedIdentityKey(key string) bool {
+	for _, reserved := range podIdentityKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// Ports created by other OVS tooling can be adopted by rainier, so that a
+// node switches to it without restarting pods: the port is recorded as the
+// container's, takes rainier's identity and the network's segment, VLAN and
+// flows, and loses the other tool's external_ids. ovs-docker records the
+// container on the interface. The ovs-cni plugin only records the pod's
+// namespace and interface, so its ports are adopted when the operator maps
+// them to their container IDs. Adopted ports keep their names, and their
+// attachment the container interface name the tool recorded, eth0 without
+// one.
+
+// foreignExternalIDs are the keys of ovs-docker and ovs-cni
+var foreignExternalIDs = []string{"container_id", "container_iface", "contNetns", "contIface", "contPodUid"}
+
+type migration struct {
+	Port        string
+	Source      string
+	ContainerID string
+	IfName      string
+	Action      string
+}
+
+type portMap map[string]string
+
+func (m portMap) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m portMap) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("expected port=containerID, got %q", value)
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
+
+// cmdMigrate adopts the container ports other tools created on a network's
+// bridge, with -map port=containerID for ports that do not record their
+// container, or lists what it would do with -dry-run:
+//
+//	rainier migrate [-conf rainier.conf] [-map port=containerID]... [-dry-run]
+func cmdMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	confPath := flags.String("conf", DefaultConfPath, "rainier network configuration")
+	dryRun := flags.Bool("dry-run", false, "list the ports without adopting them")
+	mapped := make(portMap)
+	flags.Var(mapped, "map", "adopt a port as a container's, as port=containerID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	jsonByte, err := ioutil.ReadFile(*confPath)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(jsonByte)
+	if err != nil {
+		return fmt.Errorf("invalid configuration %s: %v", *confPath, err)
+	}
+	if config.Mode != "" && config.Mode != ModeBridge {
+		return fmt.Errorf("only bridge mode networks can adopt ports")
+	}
+
+	// Keep cleanup and GC away while ports change hands
+	unlock, err := lockPorts(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	migrations, err := foreignPorts(config.PublicBridgeName, mapped)
+	if err != nil {
+		return err
+	}
+	for i := range migrations {
+		m := &migrations[i]
+		if m.ContainerID == "" || *dryRun {
+			continue
+		}
+		if err := adoptPort(config, m.Port, attachmentKey(config.Name, m.ContainerID, m.IfName)); err != nil {
+			m.Action = err.Error()
+			continue
+		}
+		m.Action = "adopted"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tSOURCE\tCONTAINER\tACTION")
+	for _, m := range migrations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Port, m.Source, shortID(m.ContainerID), m.Action)
+	}
+	return w.Flush()
+}
+
+// foreignPorts finds the bridge's container ports rainier did not create,
+// and the container each belongs to when it is known
+func foreignPorts(bridgeName string, mapped portMap) ([]migration, error) {
+	out, err := vsctl("list-ports", bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list ports of bridge %s. Error = %s", bridgeName, err)
+	}
+	migrations := []migration{}
+	for _, name := range strings.Fields(out) {
+		if interfaceExternalID(name, "rainier-container-id") != "" {
+			continue
+		}
+		m := migration{Port: name, IfName: "eth0", Action: "adopt"}
+		switch {
+		case interfaceExternalID(name, "container_id") != "":
+			m.Source = "ovs-docker"
+			m.ContainerID = interfaceExternalID(name, "container_id")
+			if ifName := interfaceExternalID(name, "container_iface"); ifName != "" {
+				m.IfName = ifName
+			}
+		case interfaceExternalID(name, "contNetns") != "":
+			m.Source = "ovs-cni"
+			if ifName := interfaceExternalID(name, "contIface"); ifName != "" {
+				m.IfName = ifName
+			}
+		case mapped[name] != "":
+			m.Source = "unknown"
+		default:
+			// The uplink, tunnels and other ports that are not a container's
+			continue
+		}
+		if mapped[name] != "" {
+			m.ContainerID = mapped[name]
+		}
+		if m.ContainerID == "" {
+			m.Action = "skipped, container unknown: pass -map " + name + "=<containerID>"
+		}
+		migrations = append(migrations, m)
+	}
+	for name := range mapped {
+		found := false
+		for _, m := range migrations {
+			found = found || m.Port == name
+		}
+		if !found {
+			return nil, fmt.Errorf("port %s is not a foreign port of bridge %s", name, bridgeName)
+		}
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Port < migrations[j].Port })
+	return migrations, nil
+}
+
+// adoptPort makes a port the attachment's as ADD would have, short of the
+// veth and IPAM, which the container already has
+func adoptPort(config *RainierConfig, hostIfName string, key string) error {
+	readHostInterfacesFromFile()
+	if owner, ok := hostInterfaces[key].(string); ok && owner != hostIfName {
+		return fmt.Errorf("attachment already has port %s", owner)
+	}
+	pod := make(podArgs)
+	if err := setPodIdentity(hostIfName, key, pod, interfaceExternalID(hostIfName, "attached-mac")); err != nil {
+		return err
+	}
+	for _, table := range []string{"interface", "port"} {
+		args := append([]string{"remove", table, hostIfName, "external_ids"}, foreignExternalIDs...)
+		if _, err := vsctl(args...); err != nil {
+			return fmt.Errorf("Failed to remove external_ids of %s %s. Error = %s", table, hostIfName, err)
+		}
+	}
+
+	// Segment, VLAN and flows of the network
+	if config.VNI != 0 {
+		tag, err := allocateSegmentTag(config.PublicBridgeName, config.VNI)
+		if err != nil {
+			return err
+		}
+		if err := setPortTag(hostIfName, tag); err != nil {
+			return err
+		}
+	}
+	vlan, err := portVlan(config, pod)
+	if err != nil {
+		return err
+	}
+	if vlan != 0 {
+		if err := setPortTag(hostIfName, vlan); err != nil {
+			return err
+		}
+	}
+	if len(config.TrunkVlans) > 0 {
+		if err := setPortTrunk(hostIfName, config.TrunkVlans, config.NativeVlan); err != nil {
+			return err
+		}
+	}
+	ofport, err := getOfport(hostIfName)
+	if err != nil {
+		return err
+	}
+	tunnels, err := peerTunnels(config.Peers, config.VNI)
+	if err != nil {
+		return err
+	}
+	flows, err := portFlows(config, pod, ofport, tunnels)
+	if err != nil {
+		return err
+	}
+	if err := dataplane.AddFlows(config.PublicBridgeName, flows...); err != nil {
+		return err
+	}
+
+	if err := recordHostInterface(key, hostIfName); err != nil {
+		return err
+	}
+	return recordPodArgs(key, pod)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+)
+
+// Mirror copies the traffic of every container port of the network to an
+// ERSPAN collector. Version 1 is ERSPAN type II, which identifies the source
+// with Index; version 2 is type III, which carries Direction and HardwareID.
+type Mirror struct {
+	Name   string  `json:"name"`
+	ERSPAN *ERSPAN `json:"erspan"`
+}
+
+type ERSPAN struct {
+	RemoteIP   string `json:"remoteIP"`
+	Version    int    `json:"version"`
+	SessionID  int    `json:"sessionID"`
+	Index      int    `json:"index"`
+	Direction  int    `json:"direction"`
+	HardwareID int    `json:"hardwareID"`
+}
+
+func validateMirror(mirror *Mirror) error {
+	if mirror == nil {
+		return nil
+	}
+	if mirror.Name == "" {
+		return fmt.Errorf("mirror name must not be empty")
+	}
+	e := mirror.ERSPAN
+	if e == nil {
+		return fmt.Errorf("mirror %s needs an erspan target", mirror.Name)
+	}
+	if net.ParseIP(e.RemoteIP) == nil {
+		return fmt.Errorf("mirror %s has invalid remoteIP %q", mirror.Name, e.RemoteIP)
+	}
+	if e.SessionID < 0 || e.SessionID > 1023 {
+		return fmt.Errorf("mirror %s has invalid sessionID %d", mirror.Name, e.SessionID)
+	}
+	switch e.Version {
+	case 1:
+		if e.Index < 0 || e.Index >= 1<<20 {
+			return fmt.Errorf("mirror %s has invalid index %d", mirror.Name, e.Index)
+		}
+	case 2:
+		if e.Direction != 0 && e.Direction != 1 {
+			return fmt.Errorf("mirror %s has invalid direction %d", mirror.Name, e.Direction)
+		}
+		if e.HardwareID < 0 || e.HardwareID > 63 {
+			return fmt.Errorf("mirror %s has invalid hardwareID %d", mirror.Name, e.HardwareID)
+		}
+	default:
+		return fmt.Errorf("mirror %s has invalid erspan version %d", mirror.Name, e.Version)
+	}
+	return nil
+}
+
+func mirrorPortName(mirror *Mirror) string {
+	return fmt.Sprintf("rsp%08x", crc32.ChecksumIEEE([]byte(mirror.Name)))
+}
+
+func ensureMirror(bridgeName string, mirror *Mirror) error {
+	portName := mirrorPortName(mirror)
+	e := mirror.ERSPAN
+	options := []string{
+		"options:remote_ip=" + e.RemoteIP,
+		"options:key=" + strconv.Itoa(e.SessionID),
+		"options:erspan_ver=" + strconv.Itoa(e.Version),
+	}
+	if e.Version == 1 {
+		options = append(options, "options:erspan_idx="+strconv.FormatInt(int64(e.Index), 16))
+	} else {
+		options = append(options,
+			"options:erspan_dir="+strconv.Itoa(e.Direction),
+			"options:erspan_hwid="+strconv.FormatInt(int64(e.HardwareID), 16))
+	}
+
+	// Create the ERSPAN port, or converge an existing one to the config
+	args := []string{"--may-exist", "add-port", bridgeName, portName,
+		"--", "set", "interface", portName, "type=erspan"}
+	if _, err := vsctl(append(args, options...)...); err != nil {
+		return fmt.Errorf("Failed to add ERSPAN port %s to bridge %s. Error = %s", portName, bridgeName, err)
+	}
+
+	// Create the mirror unless the bridge already has it
+	uuid, err := vsctl("--bare", "--columns=_uuid", "find", "mirror", "name="+mirror.Name)
+	if err != nil {
+		return err
+	}
+	if uuid == "" {
+		_, err = vsctl("--", "--id=@out", "get", "port", portName,
+			"--", "--id=@m", "create", "mirror", "name="+mirror.Name, "output-port=@out",
+			"--", "add", "bridge", bridgeName, "mirrors", "@m")
+		if err != nil {
+			return fmt.Errorf("Failed to create mirror %s on bridge %s. Error = %s", mirror.Name, bridgeName, err)
+		}
+	}
+	return nil
+}
+
+// Ports drop out of the mirror by themselves when they are deleted
+func addMirrorPort(mirror *Mirror, portName string) error {
+	_, err := vsctl("--", "--id=@p", "get", "port", portName,
+		"--", "add", "mirror", mirror.Name, "select_src_port", "@p",
+		"--", "add", "mirror", mirror.Name, "select_dst_port", "@p")
+	if err != nil {
+		return fmt.Errorf("Failed to mirror port %s to %s. Error = %s", portName, mirror.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+)
+
+const ModeJson = StateDir + "/modes.json"
+
+// DefaultOvsRunDir is where ovsdb-server puts its socket unless OVS_RUNDIR
+// says otherwise, as for ovs-vsctl
+const DefaultOvsRunDir = "/var/run/openvswitch"
+
+// Networks with ModePreferences run the first mode the node supports, so one
+// configuration serves nodes with and without OVS. The mode picked for a
+// container's attachment is recorded so that its DEL and CHECK use the same
+// one even if the node changed in between. Support is a matter of what the
+// node has, not of whether it works right now: a node with OVS whose
+// ovsdb-server is restarting must not put pods on macvlan.
+var modes = make(map[string]string)
+
+func validateModePreferences(config *RainierConfig) error {
+	if len(config.ModePreferences) == 0 {
+		return nil
+	}
+	if config.Mode != "" {
+		return fmt.Errorf("mode and modePreferences cannot be used together")
+	}
+	for _, mode := range config.ModePreferences {
+		candidate := *config
+		candidate.Mode = mode
+		if err := validateMode(&candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectMode sets config.Mode for the attachment, recording the choice when
+// record is set
+func selectMode(config *RainierConfig, key string, record bool) error {
+	if len(config.ModePreferences) == 0 {
+		return nil
+	}
+	readModesFromFile()
+	if mode, ok := modes[key]; ok {
+		config.Mode = mode
+		return nil
+	}
+	for _, mode := range config.ModePreferences {
+		if !modeSupported(config, mode) {
+			continue
+		}
+		config.Mode = mode
+		if record {
+			return updateState(ModeJson, &modes, func() error {
+				modes[key] = mode
+				return nil
+			})
+		}
+		return nil
+	}
+	return fmt.Errorf("none of the modes %v is supported on this node", config.ModePreferences)
+}
+
+func modeSupported(config *RainierConfig, mode string) bool {
+	switch mode {
+	case "", ModeBridge, ModePtp:
+		if _, err := exec.LookPath("ovs-vsctl"); err != nil {
+			return false
+		}
+		_, err := os.Stat(ovsdbSocket())
+		return err == nil
+	case ModeHostDevice:
+		_, err := netlink.LinkByName(config.HostDevice.Name)
+		return err == nil
+	case ModeMacvlan, ModeIpvlan:
+		_, err := netlink.LinkByName(config.Uplink)
+		return err == nil
+	}
+	return false
+}
+
+func ovsdbSocket() string {
+	runDir := os.Getenv("OVS_RUNDIR")
+	if runDir == "" {
+		runDir = DefaultOvsRunDir
+	}
+	return filepath.Join(runDir, "db.sock")
+}
+
+func forgetMode(key string) error {
+	return updateState(ModeJson, &modes, func() error {
+		delete(modes, key)
+		return nil
+	})
+}
+
+func readModesFromFile() error {
+	return readState(ModeJson, &modes)
+}
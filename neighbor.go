@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A pod that scans its subnet, or loops on resolving a dead neighbor, sends
+// ARP requests and neighbor solicitations that OVS floods to every port and,
+// with NORMAL learning, handles in ovs-vswitchd rather than the datapath. A
+// neighbor rate limit polices a port's requests with an OpenFlow meter, which
+// drops what exceeds the rate before it reaches the bridge. The meter is
+// shared by both families and numbered after the port's ofport. Meters take a
+// datapath that supports them, the kernel's from Linux 4.15 and OVS 2.10.
+type NeighborRateLimit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst"`
+}
+
+func validateNeighborRateLimit(limit *NeighborRateLimit) error {
+	if limit == nil {
+		return nil
+	}
+	if limit.Rate <= 0 {
+		return fmt.Errorf("invalid neighborRateLimit rate %d", limit.Rate)
+	}
+	if limit.Burst < 0 {
+		return fmt.Errorf("invalid neighborRateLimit burst %d", limit.Burst)
+	}
+	return nil
+}
+
+// neighborRateLimitPort sets up the port's meter, replacing the one a
+// previous port with the same ofport left behind, and polices the port's ARP
+// requests and neighbor solicitations with it
+func neighborRateLimitPort(bridgeName string, limit *NeighborRateLimit, pipeline *portPipeline) error {
+	meter := fmt.Sprintf("meter=%d,pktps", pipeline.ofport)
+	band := fmt.Sprintf("band=type=drop,rate=%d", limit.Rate)
+	if limit.Burst > 0 {
+		meter += ",burst"
+		band += fmt.Sprintf(",burst_size=%d", limit.Burst)
+	}
+	if _, err := ofctl("add-meter", bridgeName, meter+","+band); err != nil {
+		if _, err := ofctl("mod-meter", bridgeName, meter+","+band); err != nil {
+			return fmt.Errorf("Failed to set meter of port %d on bridge %s. Error = %s", pipeline.ofport, bridgeName, err)
+		}
+	}
+	pipeline.police("arp", "arp,arp_op=1", pipeline.ofport)
+	pipeline.police("ipv6", "icmp6,icmp_type=135", pipeline.ofport)
+	return nil
+}
+
+func deleteNeighborMeter(bridgeName string, ofport int) error {
+	if _, err := ofctl("del-meter", bridgeName, fmt.Sprintf("meter=%d", ofport)); err != nil {
+		return fmt.Errorf("Failed to delete meter of port %d from bridge %s. Error = %s", ofport, bridgeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// openNetns opens the sandbox's network namespace and makes sure rainier can
+// enter it, translating the failures seen with sandboxes that are not plain
+// Linux network namespaces (gVisor without a host netns, user-namespaced
+// runtimes) into errors that say what is wrong
+func openNetns(path string) (ns.NetNS, error) {
+	netns, err := ns.GetNS(path)
+	if err != nil {
+		switch err.(type) {
+		case ns.NSPathNotExistErr:
+			return nil, fmt.Errorf("network namespace %q does not exist, the sandbox is probably gone: %v", path, err)
+		case ns.NSPathNotNSErr:
+			return nil, fmt.Errorf("%q is not a network namespace; the runtime must give the sandbox a Linux network namespace, "+
+				"which sandboxes using their own network stack, such as gVisor with network=sandbox and no netns, do not: %v", path, err)
+		}
+		if os.IsPermission(err) {
+			return nil, fmt.Errorf("no permission to open network namespace %q, rainier must run as root: %v", path, err)
+		}
+		return nil, fmt.Errorf("failed to open netns %q: %v", path, err)
+	}
+
+	// A namespace owned by a user namespace rainier has no privileges over
+	// can be opened but not entered
+	if err := netns.Do(func(_ ns.NetNS) error { return nil }); err != nil {
+		netns.Close()
+		return nil, fmt.Errorf("cannot enter network namespace %q, it may belong to a user namespace rainier is not privileged in; "+
+			"run rainier as root in the initial user namespace: %v", path, err)
+	}
+	return netns, nil
+}
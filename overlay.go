@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Overlay stretches the bridge's L2 network across nodes over a full mesh of
+// VXLAN tunnels, for clusters without a fabric that carries the pods'
+// traffic. Every node can use the same list of Remotes: its own address is
+// found on Interface, or taken from LocalIP, and skipped. Tunnel ports are
+// protected, so that OVS never forwards from one tunnel to another and the
+// mesh cannot loop. Tunnels to nodes that left the list are removed.
+type Overlay struct {
+	VNI       uint32   `json:"vni"`
+	Interface string   `json:"interface"`
+	LocalIP   string   `json:"localIP"`
+	Remotes   []string `json:"remotes"`
+}
+
+func validateOverlay(config *RainierConfig) error {
+	o := config.Overlay
+	if o == nil {
+		return nil
+	}
+	if config.Mode != "" && config.Mode != ModeBridge {
+		return fmt.Errorf("overlay can only be used in bridge mode")
+	}
+	if o.VNI > MaxVNI || (o.VNI == 0 && config.VNI == 0) {
+		return fmt.Errorf("overlay needs a vni within 1-%d, or the network's vni", MaxVNI)
+	}
+	if (o.Interface == "") == (o.LocalIP == "") {
+		return fmt.Errorf("overlay needs either an interface or a localIP")
+	}
+	if o.LocalIP != "" && net.ParseIP(o.LocalIP) == nil {
+		return fmt.Errorf("overlay has invalid localIP %q", o.LocalIP)
+	}
+	for _, remote := range o.Remotes {
+		if net.ParseIP(remote) == nil {
+			return fmt.Errorf("overlay has invalid remote %q", remote)
+		}
+	}
+	return nil
+}
+
+// overlayLocalIP returns the node's tunnel endpoint: LocalIP, or the first
+// global address of Interface
+func overlayLocalIP(o *Overlay) (net.IP, error) {
+	if o.LocalIP != "" {
+		return net.ParseIP(o.LocalIP), nil
+	}
+	link, err := netlink.LinkByName(o.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find overlay interface %s: %v", o.Interface, err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %s: %v", o.Interface, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			return addr.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("overlay interface %s has no global address", o.Interface)
+}
+
+func overlayPortName(remote string, vni uint32) string {
+	return fmt.Sprintf("rvo%08x", crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s/%d", remote, vni))))
+}
+
+// ensureOverlay converges the bridge's tunnels to the overlay's remotes.
+// Networks with a VNI carry only their segment, tagged with tag.
+func ensureOverlay(bridgeName string, o *Overlay, vni uint32, tag int) error {
+	key := o.VNI
+	if vni != 0 {
+		key = vni
+	}
+	local, err := overlayLocalIP(o)
+	if err != nil {
+		return err
+	}
+	owner := fmt.Sprintf("%s/%d", bridgeName, key)
+
+	wanted := make(map[string]bool)
+	for _, remote := range o.Remotes {
+		if net.ParseIP(remote).Equal(local) {
+			continue
+		}
+		portName := overlayPortName(remote, key)
+		wanted[portName] = true
+		args := []string{"--may-exist", "add-port", bridgeName, portName,
+			"--", "set", "interface", portName, "type=vxlan",
+			"options:remote_ip=" + remote,
+			"options:local_ip=" + local.String(),
+			"options:key=" + strconv.FormatUint(uint64(key), 10),
+			"--", "set", "port", portName, "protected=true", fmt.Sprintf("external_ids:rainier-overlay=%q", owner)}
+		if tag != 0 {
+			args = append(args, "tag="+strconv.Itoa(tag))
+		}
+		if _, err := vsctl(args...); err != nil {
+			return fmt.Errorf("Failed to add overlay tunnel port %s to %s. Error = %s", portName, remote, err)
+		}
+	}
+
+	// Remove the tunnels of remotes that left
+	out, err := vsctl("--bare", "--columns=name", "find", "port", fmt.Sprintf("external_ids:rainier-overlay=%q", owner))
+	if err != nil {
+		return err
+	}
+	for _, portName := range strings.Fields(out) {
+		if wanted[portName] {
+			continue
+		}
+		if _, err := vsctl("--if-exists", "del-port", bridgeName, portName); err != nil {
+			return fmt.Errorf("Failed to delete overlay tunnel port %s. Error = %s", portName, err)
+		}
+	}
+	return nil
+}
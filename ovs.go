@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/digitalocean/go-openvswitch/ovs"
+)
+
+// Every flow rainier installs carries a cookie so that it can be found and
+// removed without touching flows owned by anybody else. The top 16 bits mark
+// the flow as rainier's, the next 8 bits name the feature that installed it
+// and the low 32 bits identify the owner (an OpenFlow port, or 0 for flows
+// that belong to the whole bridge).
+const (
+	cookieMagic        uint64 = 0x52a1
+	cookieMagicShift          = 48
+	cookieFeatureShift        = 40
+	cookieMagicMask    uint64 = 0xffff000000000000
+	cookieFeatureMask  uint64 = 0x0000ff0000000000
+	cookieOwnerMask    uint64 = 0x00000000ffffffff
+)
+
+const (
+	featurePeering uint8 = iota + 1
+	featureNodeProtection
+	featurePort
+	featureSeed
+	featureIPv6Only
+	featureTtl
+	featurePrefixFilter
+	featureQuarantine
+	featureDhcpGuard
+	featureRaGuard
+)
+
+var featureNames = map[uint8]string{
+	featurePeering:        "peering",
+	featureNodeProtection: "node protection",
+	featurePort:           "port pipeline",
+	featureSeed:           "seed flows",
+	featureIPv6Only:       "IPv6-only",
+	featureTtl:            "TTL",
+	featurePrefixFilter:   "prefix filter",
+	featureQuarantine:     "quarantine",
+	featureDhcpGuard:      "DHCP guard",
+	featureRaGuard:        "RA guard",
+}
+
+// OpenFlow versions rainier speaks to its bridges, the newest common one
+// wins. 1.3 is always enabled on the bridge so that subcommands, which do not
+// read the network's configuration, can talk to it, and so is 1.0 for
+// mod-port no-flood, which only 1.0 has.
+var ovsProtocols = []string{ovs.ProtocolOpenFlow13}
+
+var supportedProtocols = []string{ovs.ProtocolOpenFlow13, "OpenFlow14", "OpenFlow15"}
+
+func validateOpenFlow(protocols []string) error {
+	for _, protocol := range protocols {
+		supported := false
+		for _, s := range supportedProtocols {
+			supported = supported || protocol == s
+		}
+		if !supported {
+			return fmt.Errorf("unsupported openflow version %q, expected one of: %s", protocol, strings.Join(supportedProtocols, ", "))
+		}
+	}
+	return nil
+}
+
+func ovsClient() *ovs.Client {
+	return ovs.New(
+		ovs.Exec(runOvs),
+		ovs.Protocols(ovsProtocols),
+	)
+}
+
+// ensureBridgeProtocols enables rainier's OpenFlow versions on the bridge
+// without disabling any that another controller may rely on. An empty
+// protocols column stands for OVS's defaults, 1.0 to 1.4.
+func ensureBridgeProtocols(bridgeName string) error {
+	out, err := vsctl("get", "bridge", bridgeName, "protocols")
+	if err != nil {
+		return err
+	}
+	enabled := make(map[string]bool)
+	for _, protocol := range strings.Split(strings.Trim(out, "[]"), ",") {
+		if protocol = strings.Trim(strings.TrimSpace(protocol), `"`); protocol != "" {
+			enabled[protocol] = true
+		}
+	}
+	if len(enabled) == 0 {
+		for _, protocol := range []string{ovs.ProtocolOpenFlow10, "OpenFlow11", "OpenFlow12", ovs.ProtocolOpenFlow13, "OpenFlow14"} {
+			enabled[protocol] = true
+		}
+	}
+
+	missing := false
+	for _, protocol := range append([]string{ovs.ProtocolOpenFlow10, ovs.ProtocolOpenFlow13}, ovsProtocols...) {
+		if !enabled[protocol] {
+			enabled[protocol] = true
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	protocols := []string{}
+	for protocol := range enabled {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	if _, err := vsctl("set", "bridge", bridgeName, "protocols="+strings.Join(protocols, ",")); err != nil {
+		return fmt.Errorf("Failed to enable OpenFlow versions %s on bridge %s. Error = %s", strings.Join(protocols, ","), bridgeName, err)
+	}
+	return nil
+}
+
+func flowCookie(feature uint8, owner uint32) uint64 {
+	return cookieMagic<<cookieMagicShift | uint64(feature)<<cookieFeatureShift | uint64(owner)
+}
+
+// describeCookie names the rainier feature and owner behind a flow's cookie
+func describeCookie(cookie uint64) string {
+	if cookie&cookieMagicMask != cookieMagic<<cookieMagicShift {
+		return "not rainier's"
+	}
+	feature := uint8(cookie & cookieFeatureMask >> cookieFeatureShift)
+	name, ok := featureNames[feature]
+	if !ok {
+		name = fmt.Sprintf("feature %d", feature)
+	}
+	if owner := cookie & cookieOwnerMask; owner != 0 {
+		return fmt.Sprintf("rainier %s, port %d", name, owner)
+	}
+	return "rainier " + name
+}
+
+func ovsExec(cmd string, args ...string) (string, error) {
+	out, err := runOvs(cmd, args...)
+	if err != nil {
+		if _, ok := err.(*types.Error); ok {
+			return "", err
+		}
+		return "", fmt.Errorf("%s %s failed: %s: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func vsctl(args ...string) (string, error) {
+	return ovsExec("ovs-vsctl", args...)
+}
+
+func ofctl(args ...string) (string, error) {
+	return ovsExec("ovs-ofctl", append([]string{"-O", strings.Join(ovsProtocols, ",")}, args...)...)
+}
+
+func getOfport(ifName string) (int, error) {
+	out, err := vsctl("get", "interface", ifName, "ofport")
+	if err != nil {
+		return 0, err
+	}
+	ofport, err := strconv.Atoi(out)
+	if err != nil || ofport <= 0 {
+		return 0, fmt.Errorf("Interface %s has no OpenFlow port (ofport = %s)", ifName, out)
+	}
+	return ofport, nil
+}
+
+// ovsBundles tells whether flow changes can be bundled, which takes
+// OpenFlow 1.4
+func ovsBundles() bool {
+	for _, protocol := range ovsProtocols {
+		if protocol == "OpenFlow14" || protocol == "OpenFlow15" {
+			return true
+		}
+	}
+	return false
+}
+
+// addFlows installs a set of flows, as one bundle when possible so that
+// packets never meet half of it
+func addFlows(bridgeName string, flows ...string) error {
+	if ovsBundles() && len(flows) > 1 {
+		return bundleFlows(bridgeName, "", flows)
+	}
+	for _, flow := range flows {
+		if _, err := ofctl("add-flow", bridgeName, flow); err != nil {
+			return fmt.Errorf("Failed to add flow %q to bridge %s. Error = %s", flow, bridgeName, err)
+		}
+	}
+	return nil
+}
+
+// replaceFlows swaps the flows matching match for flows. In a bundle the
+// swap is atomic; otherwise packets briefly meet neither set.
+func replaceFlows(bridgeName string, match string, flows ...string) error {
+	if ovsBundles() {
+		return bundleFlows(bridgeName, match, flows)
+	}
+	if _, err := ofctl("del-flows", bridgeName, match); err != nil {
+		return fmt.Errorf("Failed to delete flows %s from bridge %s. Error = %s", match, bridgeName, err)
+	}
+	return addFlows(bridgeName, flows...)
+}
+
+// bundleFlows deletes the flows matching match, if any, and adds flows in a
+// single OpenFlow bundle, which OVS applies all or nothing
+func bundleFlows(bridgeName string, match string, flows []string) error {
+	return batchFlows(bridgeName, match, flows, true)
+}
+
+// batchFlows makes the same changes as bundleFlows with a single ovs-ofctl
+// call, as a bundle when asked to and otherwise one flow at a time
+func batchFlows(bridgeName string, match string, flows []string, bundle bool) error {
+	f, err := ioutil.TempFile("", "rainier-flows")
+	if err != nil {
+		return fmt.Errorf("failed to create flow bundle: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if match != "" {
+		fmt.Fprintf(f, "delete %s\n", match)
+	}
+	for _, flow := range flows {
+		fmt.Fprintf(f, "add %s\n", flow)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write flow bundle: %v", err)
+	}
+	args := []string{"add-flows", bridgeName, f.Name()}
+	if bundle {
+		args = append([]string{"--bundle"}, args...)
+	}
+	if _, err := ofctl(args...); err != nil {
+		return fmt.Errorf("Failed to apply a batch of %d flows to bridge %s. Error = %s", len(flows), bridgeName, err)
+	}
+	return nil
+}
+
+func deletePortFlows(bridgeName string, ofport int) error {
+	// Match every rainier flow owned by the port, whatever feature added it
+	cookie := flowCookie(0, uint32(ofport))
+	match := fmt.Sprintf("cookie=%#x/%#x", cookie, cookieMagicMask|cookieOwnerMask)
+	if _, err := ofctl("del-flows", bridgeName, match); err != nil {
+		return fmt.Errorf("Failed to delete flows of port %d from bridge %s. Error = %s", ofport, bridgeName, err)
+	}
+	return nil
+}
+
+func setPortTag(portName string, tag int) error {
+	if _, err := vsctl("set", "port", portName, "tag="+strconv.Itoa(tag)); err != nil {
+		return fmt.Errorf("Failed to set tag %d on port %s. Error = %s", tag, portName, err)
+	}
+	return nil
+}
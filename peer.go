@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const MaxVNI = 1<<24 - 1
+
+// Peer is a remote cluster reachable through a static VXLAN tunnel endpoint.
+// Traffic for the peer's CIDRs is steered into its tunnel only, and tunnel
+// ports never take part in flooding so that a mesh of peers cannot loop.
+type Peer struct {
+	Name     string   `json:"name"`
+	RemoteIP string   `json:"remoteIP"`
+	VNI      uint32   `json:"vni"`
+	CIDRs    []string `json:"cidrs"`
+}
+
+type peerTunnel struct {
+	peer   Peer
+	ofport int
+}
+
+func validatePeers(peers []Peer) error {
+	names := make(map[string]bool)
+	for _, peer := range peers {
+		if peer.Name == "" {
+			return fmt.Errorf("peer name must not be empty")
+		}
+		if names[peer.Name] {
+			return fmt.Errorf("duplicate peer %q", peer.Name)
+		}
+		names[peer.Name] = true
+		if net.ParseIP(peer.RemoteIP) == nil {
+			return fmt.Errorf("peer %q has invalid remoteIP %q", peer.Name, peer.RemoteIP)
+		}
+		if peer.VNI > MaxVNI {
+			return fmt.Errorf("peer %q has invalid vni %d", peer.Name, peer.VNI)
+		}
+		for _, cidr := range peer.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("peer %q has invalid cidr %q", peer.Name, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+func peerPortName(peer Peer, vni uint32) string {
+	key := peer.Name
+	if vni != 0 {
+		key = fmt.Sprintf("%s/%d", peer.Name, vni)
+	}
+	return fmt.Sprintf("rvx%08x", crc32.ChecksumIEEE([]byte(key)))
+}
+
+// peerRoute is a match of a peer's CIDR that its tunnel takes, within a
+// class of traffic of the port pipeline
+type peerRoute struct {
+	class string
+	match string
+}
+
+func peerRoutes(cidrs []string) []peerRoute {
+	routes := []peerRoute{}
+	for _, cidr := range cidrs {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		if ipnet.IP.To4() != nil {
+			routes = append(routes,
+				peerRoute{"ip", "ip,nw_dst=" + ipnet.String()},
+				peerRoute{"arp", "arp,arp_tpa=" + ipnet.String()})
+		} else {
+			routes = append(routes,
+				peerRoute{"ipv6", "ipv6,ipv6_dst=" + ipnet.String()},
+				peerRoute{"ipv6", "icmp6,icmp_type=135,nd_target=" + ipnet.String()})
+		}
+	}
+	return routes
+}
+
+// peerFlows steer the traffic of ports without a pipeline, e.g. the uplink,
+// bridge-wide. They sit below the port pipelines, which steer to peers
+// themselves after their features ran.
+func peerFlows(cookie uint64, cidrs []string, ofport int) []string {
+	flows := []string{}
+	for _, route := range peerRoutes(cidrs) {
+		flows = append(flows, fmt.Sprintf("cookie=%#x,priority=40,%s,actions=output:%d", cookie, route.match, ofport))
+	}
+	return flows
+}
+
+// ensurePeers creates one tunnel per peer. Networks without a VNI share the
+// peer's own tunnel and have their traffic steered bridge-wide as well as
+// per container port. Networks with
+// a VNI get a tunnel of their own, tagged with the network's segment, and
+// have their traffic steered per container port only, by peerPort.
+func ensurePeers(bridgeName string, peers []Peer, vni uint32, tag int, bfd bool) ([]peerTunnel, error) {
+	tunnels := []peerTunnel{}
+	for _, peer := range peers {
+		portName := peerPortName(peer, vni)
+		key := peer.VNI
+		portSettings := []string{"external_ids:rainier-peer=" + peer.Name}
+		if vni != 0 {
+			key = vni
+			portSettings = append(portSettings, "tag="+strconv.Itoa(tag))
+		}
+
+		// Create the tunnel port, or converge an existing one to the config
+		args := []string{"--may-exist", "add-port", bridgeName, portName,
+			"--", "set", "interface", portName, "type=vxlan",
+			"options:remote_ip=" + peer.RemoteIP,
+			"options:key=" + strconv.FormatUint(uint64(key), 10),
+			"bfd:enable=" + strconv.FormatBool(bfd),
+			"--", "set", "port", portName}
+		if _, err := vsctl(append(args, portSettings...)...); err != nil {
+			return nil, fmt.Errorf("Failed to add tunnel port %s for peer %s. Error = %s", portName, peer.Name, err)
+		}
+
+		ofport, err := getOfport(portName)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep broadcast and unknown unicast out of the tunnel
+		if _, err := ovsExec("ovs-ofctl", "-O", "OpenFlow10", "mod-port", bridgeName, portName, "no-flood"); err != nil {
+			return nil, fmt.Errorf("Failed to disable flooding on tunnel port %s. Error = %s", portName, err)
+		}
+
+		// Steer the peer's CIDRs into its tunnel
+		if vni == 0 {
+			cookie := flowCookie(featurePeering, uint32(ofport))
+			match := fmt.Sprintf("cookie=%#x/-1", cookie)
+			if err := replaceFlows(bridgeName, match, peerFlows(cookie, peer.CIDRs, ofport)...); err != nil {
+				return nil, err
+			}
+		}
+		tunnels = append(tunnels, peerTunnel{peer: peer, ofport: ofport})
+	}
+	if err := removeStalePeers(bridgeName, peers, vni); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// removeStalePeers deletes the tunnels of peers that left the configuration,
+// with every peering flow that steers into them. A tunnel is the network's
+// when it carries the rainier-peer of a peer and is named after that peer and
+// the network's VNI, which tells it apart from the tunnels of other networks
+// on the bridge.
+func removeStalePeers(bridgeName string, peers []Peer, vni uint32) error {
+	wanted := make(map[string]bool)
+	for _, peer := range peers {
+		wanted[peer.Name] = true
+	}
+	out, err := vsctl("list-ports", bridgeName)
+	if err != nil {
+		return err
+	}
+	for _, portName := range strings.Fields(out) {
+		name, err := vsctl("--if-exists", "get", "port", portName, "external_ids:rainier-peer")
+		if err != nil {
+			return err
+		}
+		name = strings.Trim(name, `"`)
+		if name == "" || wanted[name] || peerPortName(Peer{Name: name}, vni) != portName {
+			continue
+		}
+		if ofport, err := getOfport(portName); err == nil {
+			cookie := flowCookie(featurePeering, 0)
+			match := fmt.Sprintf("cookie=%#x/%#x,out_port=%d", cookie, cookieMagicMask|cookieFeatureMask, ofport)
+			if _, err := ofctl("del-flows", bridgeName, match); err != nil {
+				return fmt.Errorf("Failed to delete flows of peer %s from bridge %s. Error = %s", name, bridgeName, err)
+			}
+		}
+		if _, err := vsctl("--if-exists", "del-port", bridgeName, portName); err != nil {
+			return fmt.Errorf("Failed to delete tunnel port %s of peer %s. Error = %s", portName, name, err)
+		}
+	}
+	return nil
+}
+
+// peerPort steers the port's traffic for the peers' CIDRs into their tunnels
+func peerPort(tunnels []peerTunnel, pipeline *portPipeline) {
+	for _, tunnel := range tunnels {
+		for _, route := range peerRoutes(tunnel.peer.CIDRs) {
+			pipeline.route(featurePeering, route.class, route.match, fmt.Sprintf("output:%d", tunnel.ofport))
+		}
+	}
+}
+
+// peerTunnels looks up the tunnels ensurePeers created without changing them
+func peerTunnels(peers []Peer, vni uint32) ([]peerTunnel, error) {
+	tunnels := []peerTunnel{}
+	for _, peer := range peers {
+		ofport, err := getOfport(peerPortName(peer, vni))
+		if err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, peerTunnel{peer: peer, ofport: ofport})
+	}
+	return tunnels, nil
+}
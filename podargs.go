@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// podArgs holds per-pod settings. They come from CNI_ARGS, which kubelet
+// fills with K8S_POD_NAMESPACE and K8S_POD_NAME, and from the netconf's
+// args.cni, which Multus fills from the pod's network annotation. args.cni
+// wins when a key is set in both.
+type podArgs map[string]string
+
+const PodArgsJson = StateDir + "/pod-args.json"
+
+// The arguments of attached pods are recorded, as some of them shape the
+// pod's flows and the flows have to be rebuilt without a CNI call, e.g. by
+// "rainier reseed -ports" after a reboot
+var attachedPodArgs = make(map[string]podArgs)
+
+type NetConfArgs struct {
+	CNI map[string]interface{} `json:"cni"`
+}
+
+func loadPodArgs(config *RainierConfig, cniArgs string) podArgs {
+	args := make(podArgs)
+	for _, pair := range strings.Split(cniArgs, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			args[kv[0]] = kv[1]
+		}
+	}
+	if config.Args != nil {
+		for key, value := range config.Args.CNI {
+			args[key] = fmt.Sprint(value)
+		}
+	}
+	return args
+}
+
+func (a podArgs) bool(key string, fallback bool) (bool, error) {
+	value, ok := a[key]
+	if !ok {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for pod argument %s", value, key)
+	}
+	return b, nil
+}
+
+func recordPodArgs(key string, pod podArgs) error {
+	return updateState(PodArgsJson, &attachedPodArgs, func() error {
+		attachedPodArgs[key] = pod
+		return nil
+	})
+}
+
+func forgetPodArgs(key string) error {
+	return updateState(PodArgsJson, &attachedPodArgs, func() error {
+		delete(attachedPodArgs, key)
+		return nil
+	})
+}
+
+func readPodArgsFromFile() error {
+	return readState(PodArgsJson, &attachedPodArgs)
+}
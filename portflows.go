@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// portFlows returns every flow rainier installs for a container port, all of
+// them composed by its pipeline
+func portFlows(config *RainierConfig, pod podArgs, ofport int, tunnels []peerTunnel) ([]string, error) {
+	pipeline := newPortPipeline(ofport)
+	if config.Mode == ModePtp {
+		pipeline.output = "LOCAL"
+	}
+	if config.Sampling != nil {
+		if err := samplePort(config.Sampling, pod, pipeline); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.GeneveOptions) > 0 {
+		if err := genevePort(config.PublicBridgeName, config.GeneveOptions, pipeline); err != nil {
+			return nil, err
+		}
+	}
+	dscp, err := podDscp(config, pod)
+	if err != nil {
+		return nil, err
+	}
+	if dscp != nil {
+		dscpPort(dscp, pipeline)
+	}
+	if config.Ttl != nil {
+		ttlPort(config.Ttl, pipeline)
+	}
+	if config.PrefixFilter != nil {
+		prefixFilterPort(config.PrefixFilter, pipeline)
+	}
+	if config.NeighborRateLimit != nil {
+		if err := neighborRateLimitPort(config.PublicBridgeName, config.NeighborRateLimit, pipeline); err != nil {
+			return nil, err
+		}
+	}
+	if config.DhcpGuard {
+		if err := dhcpGuardPort(pod, pipeline); err != nil {
+			return nil, err
+		}
+	}
+	if raGuard(config) {
+		if err := raGuardPort(pod, pipeline); err != nil {
+			return nil, err
+		}
+	}
+	if config.IPv6Only {
+		ipv6OnlyPort(pipeline)
+	}
+	peerPort(tunnels, pipeline)
+	return pipeline.flows(), nil
+}
+
+// portPipeline composes the flows for traffic entering the bridge from a
+// container port. Every feature enabled on the port contributes actions,
+// either for all of the port's traffic or for one class of it ("ip", "ipv6",
+// "arp", ...), and the composed actions run before the packet is handed to
+// NORMAL. Composing keeps features from shadowing each other with flows of
+// the same match. Ports that must not share L2 hand their traffic to
+// another output instead. Classes of traffic the port must not send at all
+// are dropped ahead of everything else. Narrower matches within a class can
+// be policed by a meter; they take the class's actions and sit above it.
+// Traffic to peers takes the class's actions as well before it leaves
+// through a tunnel rather than the output, so the port's features apply to
+// it too.
+type portPipeline struct {
+	ofport   int
+	output   string
+	common   []string
+	classes  map[string][]string
+	policers []portPolicer
+	routes   []portRoute
+	drops    []portDrop
+}
+
+// portPolicer meters the traffic of a class that matches match as well
+type portPolicer struct {
+	class string
+	match string
+	meter int
+}
+
+// portRoute sends the traffic of a class that matches match as well to
+// output, on behalf of a feature
+type portRoute struct {
+	feature uint8
+	class   string
+	match   string
+	output  string
+}
+
+// portDrop is a class of traffic dropped on behalf of a feature, whose
+// cookie the drop flow carries so that drops can be counted per feature
+type portDrop struct {
+	feature uint8
+	class   string
+}
+
+func newPortPipeline(ofport int) *portPipeline {
+	return &portPipeline{ofport: ofport, output: "NORMAL", classes: make(map[string][]string)}
+}
+
+func (p *portPipeline) add(class string, actions ...string) {
+	if class == "" {
+		p.common = append(p.common, actions...)
+		return
+	}
+	p.classes[class] = append(p.classes[class], actions...)
+}
+
+func (p *portPipeline) police(class string, match string, meter int) {
+	p.policers = append(p.policers, portPolicer{class, match, meter})
+}
+
+func (p *portPipeline) route(feature uint8, class string, match string, output string) {
+	p.routes = append(p.routes, portRoute{feature, class, match, output})
+}
+
+func (p *portPipeline) drop(feature uint8, class string) {
+	p.drops = append(p.drops, portDrop{feature, class})
+}
+
+func (p *portPipeline) flows() []string {
+	cookie := flowCookie(featurePort, uint32(p.ofport))
+	flows := []string{}
+	if len(p.common) > 0 || p.output != "NORMAL" {
+		flows = append(flows, p.flow(cookie, 50, "", p.common))
+	}
+
+	classes := []string{}
+	for class := range p.classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		actions := append(append([]string{}, p.common...), p.classes[class]...)
+		flows = append(flows, p.flow(cookie, 51, class, actions))
+	}
+
+	for _, policer := range p.policers {
+		// OpenFlow wants the meter instruction ahead of the actions
+		actions := append([]string{fmt.Sprintf("meter:%d", policer.meter)}, p.common...)
+		actions = append(actions, p.classes[policer.class]...)
+		flows = append(flows, p.flow(cookie, 52, policer.match, actions))
+	}
+
+	for _, route := range p.routes {
+		actions := append(append([]string{}, p.common...), p.classes[route.class]...)
+		flows = append(flows, fmt.Sprintf("cookie=%#x,priority=53,in_port=%d,%s,actions=%s",
+			flowCookie(route.feature, uint32(p.ofport)), p.ofport, route.match,
+			strings.Join(append(actions, route.output), ",")))
+	}
+
+	for _, drop := range p.drops {
+		flows = append(flows, fmt.Sprintf("cookie=%#x,priority=54,in_port=%d,%s,actions=drop",
+			flowCookie(drop.feature, uint32(p.ofport)), p.ofport, drop.class))
+	}
+	return flows
+}
+
+func (p *portPipeline) flow(cookie uint64, priority int, class string, actions []string) string {
+	match := fmt.Sprintf("in_port=%d", p.ofport)
+	if class != "" {
+		match += "," + class
+	}
+	return fmt.Sprintf("cookie=%#x,priority=%d,%s,actions=%s", cookie, priority, match,
+		strings.Join(append(append([]string{}, actions...), p.output), ","))
+}
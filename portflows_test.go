@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func flowPriority(t *testing.T, flow string) int {
+	value, _ := flowField(flow, "priority")
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatalf("flow %q has no priority", flow)
+	}
+	return priority
+}
+
+// Traffic to peers has to go through the port's features before it is
+// steered into the tunnel, and drops have to win over the steering
+func TestPortFlowsPeerOrdering(t *testing.T) {
+	config := &RainierConfig{VNI: 100, Ttl: &Ttl{Decrement: true, Min: 1}}
+	tunnels := []peerTunnel{{peer: Peer{Name: "remote", CIDRs: []string{"10.1.0.0/16"}}, ofport: 9}}
+	flows, err := portFlows(config, make(podArgs), 7, tunnels)
+	if err != nil {
+		t.Fatalf("portFlows() = %v", err)
+	}
+
+	var route, class, drop string
+	for _, flow := range flows {
+		switch {
+		case strings.Contains(flow, "ip,nw_dst=10.1.0.0/16"):
+			route = flow
+		case strings.Contains(flow, "in_port=7,ip,actions="):
+			class = flow
+		case strings.Contains(flow, "in_port=7,ip,nw_ttl=0"):
+			drop = flow
+		}
+	}
+	if route == "" || class == "" || drop == "" {
+		t.Fatalf("portFlows() = %v, want a peer route, an ip class flow and a TTL drop", flows)
+	}
+	if !strings.HasSuffix(route, "actions=dec_ttl,output:9") {
+		t.Errorf("peer route %q does not take the ip class's actions before the tunnel", route)
+	}
+	if flowPriority(t, route) <= flowPriority(t, class) {
+		t.Errorf("peer route %q does not beat the class flow %q", route, class)
+	}
+	if flowPriority(t, drop) <= flowPriority(t, route) {
+		t.Errorf("drop %q does not beat the peer route %q", drop, route)
+	}
+
+	// Steering of ports without a pipeline must not preempt any pipeline
+	for _, peerFlow := range peerFlows(flowCookie(featurePeering, 9), []string{"10.1.0.0/16"}, 9) {
+		for _, flow := range flows {
+			if flowPriority(t, peerFlow) >= flowPriority(t, flow) {
+				t.Errorf("bridge-wide peer flow %q preempts port flow %q", peerFlow, flow)
+			}
+		}
+	}
+}
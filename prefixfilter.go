@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// Bogons are never legitimate destinations on the internet. Multicast and
+// link-local IPv6 are left out, since neighbor discovery and in-cluster
+// protocols need them.
+var bogons = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4",
+	"100::/64", "2001:db8::/32", "3ffe::/16", "fc00::/7", "fec0::/10",
+}
+
+// PrefixFilter drops traffic from containers to prohibited destinations
+// before it reaches another container or the uplink, whatever routes the
+// container has. Allow carves exceptions out of Deny and the bogons, e.g.
+// the network's own subnets out of RFC1918.
+type PrefixFilter struct {
+	Bogons bool     `json:"bogons"`
+	Deny   []string `json:"deny"`
+	Allow  []string `json:"allow"`
+}
+
+func validatePrefixFilter(filter *PrefixFilter) error {
+	if filter == nil {
+		return nil
+	}
+	for _, cidr := range append(append([]string{}, filter.Deny...), filter.Allow...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("prefixFilter has invalid prefix %q", cidr)
+		}
+	}
+	return nil
+}
+
+// deniedPrefixes returns the prefixes to drop, with the allowed ones cut out
+func deniedPrefixes(filter *PrefixFilter) []*net.IPNet {
+	deny := filter.Deny
+	if filter.Bogons {
+		deny = append(append([]string{}, bogons...), deny...)
+	}
+	prefixes := []*net.IPNet{}
+	for _, cidr := range deny {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		prefixes = append(prefixes, ipnet)
+	}
+	for _, cidr := range filter.Allow {
+		_, allow, _ := net.ParseCIDR(cidr)
+		remaining := []*net.IPNet{}
+		for _, prefix := range prefixes {
+			remaining = append(remaining, subtractPrefix(prefix, allow)...)
+		}
+		prefixes = remaining
+	}
+	return prefixes
+}
+
+// subtractPrefix returns the prefixes covering what of from is not in cut
+func subtractPrefix(from *net.IPNet, cut *net.IPNet) []*net.IPNet {
+	fromOnes, bits := from.Mask.Size()
+	cutOnes, cutBits := cut.Mask.Size()
+	if bits != cutBits {
+		return []*net.IPNet{from}
+	}
+	if cutOnes <= fromOnes {
+		if cut.Contains(from.IP) {
+			return nil
+		}
+		return []*net.IPNet{from}
+	}
+	if !from.Contains(cut.IP) {
+		return []*net.IPNet{from}
+	}
+
+	// Split in halves, keep the one without cut and recurse into the other
+	mask := net.CIDRMask(fromOnes+1, bits)
+	low := &net.IPNet{IP: from.IP.Mask(mask), Mask: mask}
+	high := &net.IPNet{IP: make(net.IP, len(low.IP)), Mask: mask}
+	copy(high.IP, low.IP)
+	high.IP[fromOnes/8] |= 0x80 >> uint(fromOnes%8)
+	if bytes.Equal(cut.IP.Mask(mask), low.IP) {
+		return append([]*net.IPNet{high}, subtractPrefix(low, cut)...)
+	}
+	return append([]*net.IPNet{low}, subtractPrefix(high, cut)...)
+}
+
+func prefixFilterPort(filter *PrefixFilter, pipeline *portPipeline) {
+	for _, prefix := range deniedPrefixes(filter) {
+		if prefix.IP.To4() != nil {
+			pipeline.drop(featurePrefixFilter, "ip,nw_dst="+prefix.String())
+		} else {
+			pipeline.drop(featurePrefixFilter, "ipv6,ipv6_dst="+prefix.String())
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSubtractPrefix(t *testing.T) {
+	tests := []struct {
+		from string
+		cut  string
+		want []string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", nil},
+		{"10.0.0.0/8", "0.0.0.0/0", nil},
+		{"10.0.0.0/8", "192.168.0.0/16", []string{"10.0.0.0/8"}},
+		{"10.0.0.0/8", "fd00::/8", []string{"10.0.0.0/8"}},
+		{"10.0.0.0/24", "10.0.0.0/25", []string{"10.0.0.128/25"}},
+		{"10.0.0.0/24", "10.0.0.128/25", []string{"10.0.0.0/25"}},
+		{"10.0.0.0/24", "10.0.0.64/26", []string{"10.0.0.128/25", "10.0.0.0/26"}},
+		{"10.0.0.0/30", "10.0.0.3/32", []string{"10.0.0.0/31", "10.0.0.2/32"}},
+		{"fc00::/7", "fd00::/8", []string{"fc00::/8"}},
+	}
+	for _, test := range tests {
+		_, from, _ := net.ParseCIDR(test.from)
+		_, cut, _ := net.ParseCIDR(test.cut)
+		var got []string
+		for _, prefix := range subtractPrefix(from, cut) {
+			got = append(got, prefix.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("subtractPrefix(%s, %s) = %v, want %v", test.from, test.cut, got, test.want)
+		}
+	}
+}
+
+func TestDeniedPrefixes(t *testing.T) {
+	filter := &PrefixFilter{Deny: []string{"10.0.0.0/23"}, Allow: []string{"10.0.1.0/24", "192.168.0.0/16"}}
+	var got []string
+	for _, prefix := range deniedPrefixes(filter) {
+		got = append(got, prefix.String())
+	}
+	if want := []string{"10.0.0.0/24"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deniedPrefixes() = %v, want %v", got, want)
+	}
+}
+
+func TestValidatePrefixFilter(t *testing.T) {
+	tests := []struct {
+		filter *PrefixFilter
+		valid  bool
+	}{
+		{nil, true},
+		{&PrefixFilter{Bogons: true}, true},
+		{&PrefixFilter{Deny: []string{"10.0.0.0/8", "fd00::/8"}, Allow: []string{"10.1.0.0/16"}}, true},
+		{&PrefixFilter{Deny: []string{"10.0.0.0"}}, false},
+		{&PrefixFilter{Allow: []string{"10.0.0.0/33"}}, false},
+	}
+	for _, test := range tests {
+		if err := validatePrefixFilter(test.filter); (err == nil) != test.valid {
+			t.Errorf("validatePrefixFilter(%+v) = %v, want valid %v", test.filter, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// A container's primary network, usually the cluster network, owns its
+// default routes and DNS. rainier attached as a secondary network with
+// Multus must leave them alone, or the pod's cluster traffic would follow
+// rainier's routes. Networks are primary unless isPrimaryNetwork is false.
+func isPrimaryNetwork(config *RainierConfig) bool {
+	return config.IsPrimaryNetwork == nil || *config.IsPrimaryNetwork
+}
+
+// secondaryResult drops the default routes, of both families, from the
+// result of a secondary network, whether IPAM returned them or rainier
+// added them
+func secondaryResult(result *current.Result) {
+	routes := []*types.Route{}
+	for _, route := range result.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+			routes = append(routes, route)
+		}
+	}
+	result.Routes = routes
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/vishvananda/netlink"
+)
+
+const ModeBridge = "bridge"
+const ModePtp = "ptp"
+
+// In ptp mode containers share no L2 with each other. Every address becomes
+// a host route, the container routes everything via a link-local gateway
+// that resolves to the bridge's own MAC, and OVS hands all of the
+// container's traffic to the host (the bridge's LOCAL port), which routes it.
+// Neighbors on both sides are static, so there is no ARP or ND to scale.
+var ptpGatewayV4 = net.IPv4(169, 254, 1, 1)
+var ptpGatewayV6 = net.ParseIP("fe80::1")
+
+func validateMode(config *RainierConfig) error {
+	switch config.Mode {
+	case "", ModeBridge:
+		return nil
+	case ModePtp:
+		if len(config.Peers) > 0 || config.VNI != 0 || len(config.SubnetVlans) > 0 {
+			return fmt.Errorf("ptp mode cannot be used with peers, vni or subnetVlans")
+		}
+		return nil
+	case ModeHostDevice:
+		return validateHostDevice(config.HostDevice)
+	case ModeMacvlan, ModeIpvlan:
+		return validateLinkMode(config)
+	}
+	return fmt.Errorf("invalid mode %q", config.Mode)
+}
+
+func ptpGateway(version string) net.IP {
+	if version == "6" {
+		return ptpGatewayV6
+	}
+	return ptpGatewayV4
+}
+
+// ptpResult narrows every address to a host route and points the container's
+// routes at the link-local gateway, adding a default route per family when
+// IPAM returned none
+func ptpResult(result *current.Result) {
+	families := make(map[string]bool)
+	for _, ipc := range result.IPs {
+		bits := 32
+		if ipVersion(ipc.Address.IP) == "6" {
+			bits = 128
+		}
+		ipc.Address.Mask = net.CIDRMask(bits, bits)
+		ipc.Gateway = ptpGateway(ipVersion(ipc.Address.IP))
+		families[ipVersion(ipc.Address.IP)] = true
+	}
+	for _, route := range result.Routes {
+		route.GW = nil
+	}
+	if len(result.Routes) == 0 {
+		for version := range families {
+			_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+			if version == "6" {
+				_, dst, _ = net.ParseCIDR("::/0")
+			}
+			result.Routes = append(result.Routes, &types.Route{Dst: *dst})
+		}
+	}
+}
+
+// configurePtpContainer must run in the container's namespace
+func configurePtpContainer(ifName string, result *current.Result, gatewayMAC net.HardwareAddr) error {
+	// Addresses only, the routes need the gateway to be on-link first
+	addrs := *result
+	addrs.Routes = nil
+	if err := ipam.ConfigureIface(ifName, &addrs); err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to find %s in container: %v", ifName, err)
+	}
+	for _, ipc := range result.IPs {
+		gateway := ptpGateway(ipVersion(ipc.Address.IP))
+		if ipVersion(ipc.Address.IP) == "4" {
+			onLink := &net.IPNet{IP: gateway, Mask: net.CIDRMask(32, 32)}
+			if err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: onLink, Scope: netlink.SCOPE_LINK}); err != nil {
+				return fmt.Errorf("failed to add route to gateway %s: %v", gateway, err)
+			}
+		}
+		if err := setPermanentNeighbor(link, gateway, gatewayMAC); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range result.Routes {
+		gateway := ptpGatewayV4
+		if route.Dst.IP.To4() == nil {
+			gateway = ptpGatewayV6
+		}
+		dst := route.Dst
+		if err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &dst, Gw: gateway}); err != nil {
+			return fmt.Errorf("failed to add route %s via %s: %v", dst.String(), gateway, err)
+		}
+	}
+	return nil
+}
+
+func setPermanentNeighbor(link netlink.Link, address net.IP, mac net.HardwareAddr) error {
+	family := netlink.FAMILY_V4
+	if address.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	neigh := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       family,
+		State:        netlink.NUD_PERMANENT,
+		IP:           address,
+		HardwareAddr: mac,
+	}
+	if err := netlink.NeighSet(neigh); err != nil {
+		return fmt.Errorf("failed to set neighbor %s on %s: %v", address, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func bridgeLink(bridgeName string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find bridge interface %s: %v", bridgeName, err)
+	}
+	return link, nil
+}
+
+// setupPtpHost routes the container's addresses to the bridge interface and
+// sends what the host routes there to the container's port
+func setupPtpHost(bridgeName string, hostIfName string, ofport int, container *current.Interface, result *current.Result) error {
+	link, err := bridgeLink(bridgeName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %s up: %v", bridgeName, err)
+	}
+	mac, err := net.ParseMAC(container.Mac)
+	if err != nil {
+		return fmt.Errorf("invalid container MAC %q: %v", container.Mac, err)
+	}
+
+	for _, ipc := range result.IPs {
+		if ipVersion(ipc.Address.IP) == "6" {
+			err = ip.EnableIP6Forward()
+		} else {
+			err = ip.EnableIP4Forward()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+		dst := ipc.Address
+		if err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &dst, Scope: netlink.SCOPE_LINK}); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", dst.String(), err)
+		}
+		if err := setPermanentNeighbor(link, ipc.Address.IP, mac); err != nil {
+			return err
+		}
+	}
+
+	// Nothing but the container's own traffic may reach its port
+	if _, err := ovsExec("ovs-ofctl", "-O", "OpenFlow10", "mod-port", bridgeName, hostIfName, "no-flood"); err != nil {
+		return fmt.Errorf("Failed to disable flooding on port %s. Error = %s", hostIfName, err)
+	}
+	cookie := flowCookie(featurePort, uint32(ofport))
+	return addFlows(bridgeName, fmt.Sprintf("cookie=%#x,priority=100,in_port=LOCAL,dl_dst=%s,actions=output:%d", cookie, mac, ofport))
+}
+
+func teardownPtpHost(bridgeName string, owned []string) error {
+	link, err := bridgeLink(bridgeName)
+	if err != nil {
+		// The routes went away with the bridge
+		return nil
+	}
+	for _, address := range owned {
+		addr := net.ParseIP(address)
+		if addr == nil {
+			continue
+		}
+		bits := 128
+		if addr.To4() != nil {
+			bits = 32
+		}
+		dst := &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}
+		netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK})
+		netlink.NeighDel(&netlink.Neigh{LinkIndex: link.Attrs().Index, IP: addr})
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	podQueue  = 0
+	hostQueue = 1
+)
+
+// NodeProtection shares the uplink between the node and its containers. Node
+// traffic (kubelet, API server, etcd) leaves the bridge's local port and is
+// guaranteed HostMinRate; container traffic uses the default queue. Rates are
+// in bits per second.
+type NodeProtection struct {
+	MaxRate     uint64 `json:"maxRate"`
+	HostMinRate uint64 `json:"hostMinRate"`
+}
+
+func validateNodeProtection(uplink string, np *NodeProtection) error {
+	if np == nil {
+		return nil
+	}
+	if uplink == "" {
+		return fmt.Errorf("nodeProtection requires an uplink")
+	}
+	if np.MaxRate == 0 || np.HostMinRate == 0 || np.HostMinRate > np.MaxRate {
+		return fmt.Errorf("nodeProtection needs 0 < hostMinRate <= maxRate")
+	}
+	return nil
+}
+
+func ensureUplink(bridgeName string, uplink string) error {
+	if _, err := vsctl("--may-exist", "add-port", bridgeName, uplink); err != nil {
+		return fmt.Errorf("Failed to add uplink %s to bridge %s. Error = %s", uplink, bridgeName, err)
+	}
+	return nil
+}
+
+func ensureNodeProtection(bridgeName string, uplink string, np *NodeProtection) error {
+	maxRate := "other-config:max-rate=" + strconv.FormatUint(np.MaxRate, 10)
+	minRate := "other-config:min-rate=" + strconv.FormatUint(np.HostMinRate, 10)
+	id := "node-protection-" + uplink
+
+	qos, err := qosRecords("qos", id)
+	if err != nil {
+		return err
+	}
+	pod, err := qosRecords("queue", id+"-pod")
+	if err != nil {
+		return err
+	}
+	host, err := qosRecords("queue", id+"-host")
+	if err != nil {
+		return err
+	}
+
+	// Converge the existing records instead of piling up new ones on every
+	// ADD. Without exactly one of each, e.g. when an older version created
+	// queues without external_ids, they are created again; OVSDB collects
+	// the records the port no longer refers to.
+	if len(qos) == 1 && len(pod) == 1 && len(host) == 1 {
+		_, err = vsctl("set", "port", uplink, "qos="+qos[0],
+			"--", "set", "qos", qos[0], maxRate,
+			fmt.Sprintf("queues:%d=%s", podQueue, pod[0]), fmt.Sprintf("queues:%d=%s", hostQueue, host[0]),
+			"--", "set", "queue", pod[0], maxRate,
+			"--", "set", "queue", host[0], maxRate, minRate)
+	} else {
+		_, err = vsctl("set", "port", uplink, "qos=@qos",
+			"--", "--id=@qos", "create", "qos", "type=linux-htb", maxRate, "external_ids:rainier-qos="+id,
+			fmt.Sprintf("queues:%d=@pod", podQueue), fmt.Sprintf("queues:%d=@host", hostQueue),
+			"--", "--id=@pod", "create", "queue", maxRate, "external_ids:rainier-qos="+id+"-pod",
+			"--", "--id=@host", "create", "queue", maxRate, minRate, "external_ids:rainier-qos="+id+"-host")
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to set up node protection on uplink %s. Error = %s", uplink, err)
+	}
+
+	// Put traffic from the node itself into the protected queue
+	cookie := flowCookie(featureNodeProtection, 0)
+	return addFlows(bridgeName,
+		fmt.Sprintf("cookie=%#x,priority=10,in_port=LOCAL,actions=set_queue:%d,NORMAL", cookie, hostQueue))
+}
+
+// qosRecords returns the UUIDs of a table's records rainier created for id
+func qosRecords(table string, id string) ([]string, error) {
+	out, err := vsctl("--bare", "--columns=_uuid", "find", table, "external_ids:rainier-qos="+id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find %s records of %s. Error = %s", table, id, err)
+	}
+	return strings.Fields(out), nil
+}
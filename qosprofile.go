@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+)
+
+// QosProfile is a named class of service that pods pick with their
+// qosProfile argument, e.g. set by Multus from the pod's network annotation,
+// instead of carrying limits of their own. Rate and Burst, in bits per second
+// and bits, limit the pod's traffic both ways as the bandwidth capability
+// does, MinRate guarantees it a share of what leaves the bridge towards it
+// and Dscp marks what it sends. Profiles are the platform team's to define:
+// a pod whose profile has a rate cannot pass bandwidth limits of its own.
+type QosProfile struct {
+	Rate    uint64 `json:"rate"`
+	Burst   uint64 `json:"burst"`
+	MinRate uint64 `json:"minRate"`
+	Dscp    *int   `json:"dscp"`
+}
+
+// QosProfileSet holds the network's QoS profiles by name
+type QosProfileSet map[string]QosProfile
+
+func validateQosProfiles(config *RainierConfig) error {
+	for name, profile := range config.QosProfiles {
+		if profile.Burst > 0 && profile.Rate == 0 {
+			return fmt.Errorf("QoS profile %s: burst needs a rate", name)
+		}
+		if profile.Rate > 0 && profile.Rate < 1000 {
+			return fmt.Errorf("QoS profile %s: rate must be at least 1000 bits per second", name)
+		}
+		if profile.MinRate > 0 && (profile.Rate == 0 || profile.MinRate > profile.Rate) {
+			return fmt.Errorf("QoS profile %s: minRate needs a rate at least as high", name)
+		}
+		if profile.Dscp != nil && (*profile.Dscp < 0 || *profile.Dscp > 63) {
+			return fmt.Errorf("QoS profile %s: dscp must be within 0-63", name)
+		}
+	}
+	if config.DefaultQosProfile != "" {
+		if _, ok := config.QosProfiles[config.DefaultQosProfile]; !ok {
+			return fmt.Errorf("unknown defaultQosProfile %q", config.DefaultQosProfile)
+		}
+	}
+	return nil
+}
+
+// podQosProfile returns the profile the pod picked, or the network's
+// default, nil without either
+func podQosProfile(config *RainierConfig, pod podArgs) (*QosProfile, error) {
+	name, ok := pod["qosProfile"]
+	if !ok {
+		name = config.DefaultQosProfile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := config.QosProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown QoS profile %q", name)
+	}
+	return &profile, nil
+}
+
+// podBandwidth returns the pod's bandwidth limits and guaranteed rate, from
+// the runtime or from its QoS profile, nil without limits
+func podBandwidth(config *RainierConfig, pod podArgs) (*Bandwidth, uint64, error) {
+	profile, err := podQosProfile(config, pod)
+	if err != nil {
+		return nil, 0, err
+	}
+	if profile == nil || profile.Rate == 0 {
+		return config.RuntimeConfig.Bandwidth, 0, nil
+	}
+	if config.RuntimeConfig.Bandwidth != nil {
+		return nil, 0, fmt.Errorf("pods with a QoS profile cannot pass bandwidth limits")
+	}
+	bw := &Bandwidth{
+		IngressRate:  profile.Rate,
+		IngressBurst: profile.Burst,
+		EgressRate:   profile.Rate,
+		EgressBurst:  profile.Burst,
+	}
+	return bw, profile.MinRate, nil
+}
+
+// podDscp returns the DSCP policy of the pod's traffic: its QoS profile's
+// marking, or the network's policy
+func podDscp(config *RainierConfig, pod podArgs) (*Dscp, error) {
+	profile, err := podQosProfile(config, pod)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil && profile.Dscp != nil {
+		return &Dscp{Policy: DscpRewrite, Value: *profile.Dscp}, nil
+	}
+	return config.Dscp, nil
+}
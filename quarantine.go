@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Quarantine flows sit above the port pipeline, at priorities 500 and 501 of
+// table 0. They carry an OpenFlow hard timeout, so OVS lifts the quarantine
+// by itself even if nobody comes back to do it.
+const MaxQuarantine = 65535 * time.Second
+
+// cmdQuarantine cuts a container off the network for a while, except for
+// ARP, neighbor discovery and traffic to and from the allowed prefixes:
+//
+//	rainier quarantine [-timeout 1h] [-allow cidr,...] <containerID>
+//	rainier quarantine -lift <containerID>
+func cmdQuarantine(args []string) error {
+	flags := flag.NewFlagSet("quarantine", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", time.Hour, "lift the quarantine after this long")
+	allow := flags.String("allow", "", "comma separated prefixes the container may still talk to, e.g. management networks")
+	lift := flags.Bool("lift", false, "lift the quarantine now")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: rainier quarantine [flags] <containerID>")
+	}
+	key, err := containerAttachment(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	bridgeName, _, ofport, err := containerPort(key)
+	if err != nil {
+		return err
+	}
+	if *lift {
+		return liftQuarantine(bridgeName, ofport)
+	}
+
+	if *timeout < time.Second || *timeout > MaxQuarantine {
+		return fmt.Errorf("timeout must be within 1s-%s", MaxQuarantine)
+	}
+	allowed := []*net.IPNet{}
+	if *allow != "" {
+		for _, cidr := range strings.Split(*allow, ",") {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid prefix %q", cidr)
+			}
+			allowed = append(allowed, ipnet)
+		}
+	}
+	readAddressesFromFile()
+	owned := []net.IP{}
+	for _, address := range addresses[key] {
+		if ip := net.ParseIP(address); ip != nil {
+			owned = append(owned, ip)
+		}
+	}
+
+	// Replace rather than stack on an earlier quarantine, which restarts the
+	// timeout
+	return replaceFlows(bridgeName, quarantineMatch(ofport), quarantineFlows(ofport, owned, allowed, *timeout)...)
+}
+
+func quarantineFlows(ofport int, owned []net.IP, allowed []*net.IPNet, timeout time.Duration) []string {
+	prefix := fmt.Sprintf("cookie=%#x,hard_timeout=%d", flowCookie(featureQuarantine, uint32(ofport)), int(timeout.Seconds()))
+	flows := []string{
+		fmt.Sprintf("%s,priority=501,in_port=%d,arp,actions=NORMAL", prefix, ofport),
+		fmt.Sprintf("%s,priority=501,in_port=%d,icmp6,icmp_type=135,actions=NORMAL", prefix, ofport),
+		fmt.Sprintf("%s,priority=501,in_port=%d,icmp6,icmp_type=136,actions=NORMAL", prefix, ofport),
+		fmt.Sprintf("%s,priority=500,in_port=%d,actions=drop", prefix, ofport),
+	}
+	for _, ipnet := range allowed {
+		ipMatch, src, dst := "ip", "nw_src", "nw_dst"
+		if ipnet.IP.To4() == nil {
+			ipMatch, src, dst = "ipv6", "ipv6_src", "ipv6_dst"
+		}
+		flows = append(flows, fmt.Sprintf("%s,priority=501,in_port=%d,%s,%s=%s,actions=NORMAL", prefix, ofport, ipMatch, dst, ipnet))
+		for _, address := range owned {
+			if (address.To4() == nil) == (ipnet.IP.To4() == nil) {
+				flows = append(flows, fmt.Sprintf("%s,priority=501,%s,%s=%s,%s=%s,actions=NORMAL", prefix, ipMatch, src, ipnet, dst, address))
+			}
+		}
+	}
+	// Traffic to the container is told by its addresses, which unlike the
+	// output port can be matched in table 0
+	for _, address := range owned {
+		if address.To4() != nil {
+			flows = append(flows, fmt.Sprintf("%s,priority=500,ip,nw_dst=%s,actions=drop", prefix, address))
+		} else {
+			flows = append(flows, fmt.Sprintf("%s,priority=500,ipv6,ipv6_dst=%s,actions=drop", prefix, address))
+		}
+	}
+	return flows
+}
+
+func quarantineMatch(ofport int) string {
+	return fmt.Sprintf("cookie=%#x/-1", flowCookie(featureQuarantine, uint32(ofport)))
+}
+
+func liftQuarantine(bridgeName string, ofport int) error {
+	if _, err := ofctl("del-flows", bridgeName, quarantineMatch(ofport)); err != nil {
+		return fmt.Errorf("Failed to lift quarantine of port %d on bridge %s. Error = %s", ofport, bridgeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuarantineFlows(t *testing.T) {
+	_, dns, _ := net.ParseCIDR("10.96.0.10/32")
+	_, registry, _ := net.ParseCIDR("fd00:10::/64")
+	owned := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}
+	flows := quarantineFlows(7, owned, []*net.IPNet{dns, registry}, 10*time.Minute)
+
+	prefix := fmt.Sprintf("cookie=%#x,hard_timeout=600", flowCookie(featureQuarantine, 7))
+	want := []string{
+		prefix + ",priority=501,in_port=7,arp,actions=NORMAL",
+		prefix + ",priority=501,in_port=7,icmp6,icmp_type=135,actions=NORMAL",
+		prefix + ",priority=501,in_port=7,icmp6,icmp_type=136,actions=NORMAL",
+		prefix + ",priority=500,in_port=7,actions=drop",
+		prefix + ",priority=501,in_port=7,ip,nw_dst=10.96.0.10/32,actions=NORMAL",
+		prefix + ",priority=501,ip,nw_src=10.96.0.10/32,nw_dst=10.0.0.2,actions=NORMAL",
+		prefix + ",priority=501,in_port=7,ipv6,ipv6_dst=fd00:10::/64,actions=NORMAL",
+		prefix + ",priority=501,ipv6,ipv6_src=fd00:10::/64,ipv6_dst=fd00::2,actions=NORMAL",
+		prefix + ",priority=500,ip,nw_dst=10.0.0.2,actions=drop",
+		prefix + ",priority=500,ipv6,ipv6_dst=fd00::2,actions=drop",
+	}
+	if !reflect.DeepEqual(flows, want) {
+		t.Errorf("quarantineFlows() =\n%v\nwant\n%v", flows, want)
+	}
+}
+
+func TestQuarantineFlowsWithoutAllowed(t *testing.T) {
+	flows := quarantineFlows(7, nil, nil, time.Minute)
+	if len(flows) != 4 {
+		t.Errorf("quarantineFlows() without allowed prefixes or addresses = %v, want 4 flows", flows)
+	}
+}
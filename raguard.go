@@ -0,0 +1,20 @@
+package main
+
+// A pod that sends router advertisements can make its neighbors route
+// through it, or take over their addresses with a prefix of its own. RA
+// guard drops the router advertisements pods send, unless the network turns
+// it off with raGuard false or the pod routes for the network and is allowed
+// with the "ipv6Router" pod argument. IPv6-only networks drop them anyway.
+
+func raGuard(config *RainierConfig) bool {
+	return (config.RaGuard == nil || *config.RaGuard) && !config.IPv6Only
+}
+
+func raGuardPort(pod podArgs, pipeline *portPipeline) error {
+	router, err := pod.bool("ipv6Router", false)
+	if err != nil || router {
+		return err
+	}
+	pipeline.drop(featureRaGuard, "icmp6,icmp_type=134")
+	return nil
+}
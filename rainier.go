@@ -3,144 +3,1063 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"os"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
-	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/digitalocean/go-openvswitch/ovs"
+	"github.com/vishvananda/netlink"
 )
 
 const DefaultMTU = 1500
-const HostInterfaceJson = "/tmp/rainier.json"
+const MinMTU = 68
+const MinIPv6MTU = 1280
+const MaxMTU = 65535
+const HostInterfaceJson = StateDir + "/interfaces.json"
 
 var hostInterfaces = make(map[string]interface{})
 
 type RainierConfig struct {
 	types.NetConf
-	PublicBridgeName string `json:"publicBridgeName"`
+	PublicBridgeName  string             `json:"publicBridgeName"`
+	Peers             []Peer             `json:"peers"`
+	VNI               uint32             `json:"vni"`
+	Uplink            string             `json:"uplink"`
+	NodeProtection    *NodeProtection    `json:"nodeProtection"`
+	CircuitBreaker    *CircuitBreaker    `json:"ovsCircuitBreaker"`
+	OvsTimeout        int                `json:"ovsTimeout"`
+	Deadline          int                `json:"deadline"`
+	OvsdbState        bool               `json:"ovsdbState"`
+	ReportDir         string             `json:"reportDir"`
+	AllowedIpamTypes  []string           `json:"allowedIpamTypes"`
+	SubnetVlans       []SubnetVlan       `json:"subnetVlans"`
+	VlanTranslations  []VlanTranslation  `json:"vlanTranslations"`
+	VlanUplink        string             `json:"vlanUplink"`
+	ExtraAddresses    []ExtraAddress     `json:"extraAddresses"`
+	Mirror            *Mirror            `json:"mirror"`
+	Sampling          *Sampling          `json:"sampling"`
+	Args              *NetConfArgs       `json:"args"`
+	MaxConcurrency    int                `json:"maxConcurrency"`
+	SelfHeal          bool               `json:"selfHeal"`
+	Mode              string             `json:"mode"`
+	HostDevice        *HostDevice        `json:"hostDevice"`
+	LinkMode          string             `json:"linkMode"`
+	ModePreferences   []string           `json:"modePreferences"`
+	Readiness         *Readiness         `json:"readiness"`
+	SeedFlows         []string           `json:"seedFlows"`
+	IPv6Only          bool               `json:"ipv6Only"`
+	Dscp              *Dscp              `json:"dscp"`
+	QosProfiles       QosProfileSet      `json:"qosProfiles"`
+	DefaultQosProfile string             `json:"defaultQosProfile"`
+	SkipIPConfig      bool               `json:"skipIPConfig"`
+	RuntimeConfig     RuntimeConfig      `json:"runtimeConfig"`
+	Ttl               *Ttl               `json:"ttl"`
+	PrefixFilter      *PrefixFilter      `json:"prefixFilter"`
+	IsGateway         bool               `json:"isGateway"`
+	GatewayPort       string             `json:"gatewayPort"`
+	IPMasq            bool               `json:"ipMasq"`
+	IPFamilies        []string           `json:"ipFamilies"`
+	PreferredFamily   string             `json:"preferredFamily"`
+	NeighborRateLimit *NeighborRateLimit `json:"neighborRateLimit"`
+	DhcpGuard         bool               `json:"dhcpGuard"`
+	RaGuard           *bool              `json:"raGuard"`
+	MetadataHooks     []MetadataHook     `json:"metadataHooks"`
+	MTU               int                `json:"mtu"`
+	OpenFlow          []string           `json:"openflow"`
+	Vlan              int                `json:"vlan"`
+	TrunkVlans        []int              `json:"trunkVlans"`
+	NativeVlan        int                `json:"nativeVlan"`
+	AllowedPodVlans   []string           `json:"allowedPodVlans"`
+	Overlay           *Overlay           `json:"overlay"`
+	Tunnels           []Tunnel           `json:"tunnels"`
+	Backend           string             `json:"backend"`
+	GeneveOptions     []GeneveOption     `json:"geneveOptions"`
+	IfNamePrefix      string             `json:"ifNamePrefix"`
+	Slaac             *Slaac             `json:"slaac"`
+	IsPrimaryNetwork  *bool              `json:"isPrimaryNetwork"`
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func loadConfig(data []byte) (*RainierConfig, error) {
 	config := &RainierConfig{}
-	if err := json.Unmarshal(args.StdinData, config); err != nil {
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := validateNetworkName(config.Name); err != nil {
+		return nil, err
+	}
+	if err := validatePeers(config.Peers); err != nil {
+		return nil, err
+	}
+	if err := validateMode(config); err != nil {
+		return nil, err
+	}
+	if err := validateModePreferences(config); err != nil {
+		return nil, err
+	}
+	if err := validateReadiness(config); err != nil {
+		return nil, err
+	}
+	if err := validateSeedFlows(config.SeedFlows); err != nil {
+		return nil, err
+	}
+	if config.VNI > MaxVNI {
+		return nil, fmt.Errorf("invalid vni %d", config.VNI)
+	}
+	if err := validateSubnetVlans(config.SubnetVlans); err != nil {
+		return nil, err
+	}
+	if config.VNI != 0 && len(config.SubnetVlans) > 0 {
+		return nil, fmt.Errorf("vni and subnetVlans cannot be used together")
+	}
+	if err := validateNetworkVlan(config); err != nil {
+		return nil, err
+	}
+	if err := validateTrunk(config); err != nil {
+		return nil, err
+	}
+	if err := validateAllowedPodVlans(config.AllowedPodVlans); err != nil {
+		return nil, err
+	}
+	if err := validateOverlay(config); err != nil {
+		return nil, err
+	}
+	if err := validateTunnels(config.Tunnels); err != nil {
+		return nil, err
+	}
+	if err := validateGeneveOptions(config); err != nil {
+		return nil, err
+	}
+	if err := validateIfNamePrefix(config.IfNamePrefix); err != nil {
+		return nil, err
+	}
+	if err := validateSlaac(config); err != nil {
+		return nil, err
+	}
+	if err := selectBackend(config.Backend); err != nil {
+		return nil, err
+	}
+	if err := validateVlanTranslations(config.VlanTranslations, config.Uplink); err != nil {
+		return nil, err
+	}
+	if err := validateExtraAddresses(config.ExtraAddresses); err != nil {
+		return nil, err
+	}
+	if err := validateMirror(config.Mirror); err != nil {
+		return nil, err
+	}
+	if err := validateSampling(config.Sampling); err != nil {
+		return nil, err
+	}
+	if err := validateDscp(config.Dscp); err != nil {
+		return nil, err
+	}
+	if err := validateQosProfiles(config); err != nil {
+		return nil, err
+	}
+	if err := validateTtl(config.Ttl); err != nil {
+		return nil, err
+	}
+	if err := validatePrefixFilter(config.PrefixFilter); err != nil {
+		return nil, err
+	}
+	if err := validateNeighborRateLimit(config.NeighborRateLimit); err != nil {
+		return nil, err
+	}
+	if err := validatePortMappings(config.RuntimeConfig.PortMappings); err != nil {
+		return nil, err
+	}
+	if err := validateBandwidth(config.RuntimeConfig.Bandwidth); err != nil {
+		return nil, err
+	}
+	if err := validateStaticIPs(config.RuntimeConfig.IPs); err != nil {
+		return nil, err
+	}
+	if err := validateIPFamilies(config); err != nil {
+		return nil, err
+	}
+	if err := validateMetadataHooks(config.MetadataHooks); err != nil {
+		return nil, err
+	}
+	if config.IsGateway && config.Mode != "" && config.Mode != ModeBridge {
+		return nil, fmt.Errorf("isGateway can only be used in bridge mode")
+	}
+	if err := validateGatewayPort(config); err != nil {
+		return nil, err
+	}
+	if err := validateMTU(config); err != nil {
+		return nil, err
+	}
+	if err := validateOpenFlow(config.OpenFlow); err != nil {
+		return nil, err
+	}
+	if len(config.OpenFlow) > 0 {
+		ovsProtocols = config.OpenFlow
+	}
+	if err := validateNodeProtection(config.Uplink, config.NodeProtection); err != nil {
+		return nil, err
+	}
+	if err := validateCircuitBreaker(config.CircuitBreaker); err != nil {
+		return nil, err
+	}
+	ovsBreaker = config.CircuitBreaker
+	if config.MaxConcurrency < 0 {
+		return nil, fmt.Errorf("invalid maxConcurrency %d", config.MaxConcurrency)
+	}
+	if config.OvsTimeout < 0 {
+		return nil, fmt.Errorf("invalid ovsTimeout %d", config.OvsTimeout)
+	}
+	if config.OvsTimeout > 0 {
+		ovsTimeout = time.Duration(config.OvsTimeout) * time.Second
+	}
+	if config.Deadline < 0 {
+		return nil, fmt.Errorf("invalid deadline %d", config.Deadline)
+	}
+	startDeadline(config.Deadline)
+	return config, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	config, err := loadConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	report := newReport(config.ReportDir, "ADD", args, config.Name)
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	rollback := false
+	defer func() {
+		if err != nil && rollback {
+			if rollbackErr := rollbackAdd(config, args, report.ipamDone); rollbackErr != nil {
+				fmt.Fprintf(os.Stderr, "rainier: failed to roll back ADD: %v\n", rollbackErr)
+			}
+		}
+		report.finish(err)
+	}()
+
+	// Reject interface names the kernel would
+	if err := validateIfName(args.IfName); err != nil {
+		return err
+	}
+
+	// Leave the dataplane alone during maintenance
+	if err := report.step("checkMaintenance"); err != nil {
+		return err
+	}
+	if err := maintenanceMode(); err != nil {
 		return err
 	}
 
+	// Back off while OVS is failing
+	if err := report.step("checkBreaker"); err != nil {
+		return err
+	}
+	if err := breakerOpen(); err != nil {
+		return err
+	}
+
+	// Wait for a turn to change the dataplane
+	if err := report.step("acquireSlot"); err != nil {
+		return err
+	}
+	release, err := acquireSlot(config.MaxConcurrency)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Pick the mode the node supports
+	if err := report.step("selectMode"); err != nil {
+		return err
+	}
+	if err := selectMode(config, key, true); err != nil {
+		return err
+	}
+
+	// Hand a host NIC to the container instead of attaching it to OVS,
+	// undoing it if ADD fails
+	if config.Mode == ModeHostDevice {
+		rollback = true
+		return cmdAddHostDevice(config, args, report)
+	}
+
+	// Attach the container to the uplink directly on nodes without OVS
+	if config.Mode == ModeMacvlan || config.Mode == ModeIpvlan {
+		rollback = true
+		return cmdAddLink(config, args, report)
+	}
+
 	// Create OVS bridges
-	if err := createOvsBr(config.PublicBridgeName); err != nil {
+	if err := report.step("createBridge"); err != nil {
+		return err
+	}
+	if err := dataplane.EnsureBridge(config.PublicBridgeName); err != nil {
+		return err
+	}
+	if len(config.SeedFlows) > 0 {
+		if err := ensureSeedFlows(config.PublicBridgeName, config.SeedFlows); err != nil {
+			return err
+		}
+	}
+
+	// Attach the uplink and protect node traffic on it
+	if err := report.step("attachUplink"); err != nil {
+		return err
+	}
+	if config.Uplink != "" {
+		if err := ensureUplink(config.PublicBridgeName, config.Uplink); err != nil {
+			return err
+		}
+		if config.NodeProtection != nil {
+			if err := ensureNodeProtection(config.PublicBridgeName, config.Uplink, config.NodeProtection); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Keep cleanup away from the veth until it is recorded, and DEL and GC
+	// from releasing the segment until the port is tagged with it
+	unlock, err := lockPorts(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Allocate the network's segment on the bridge
+	if err := report.step("allocateSegment"); err != nil {
+		return err
+	}
+	tag := 0
+	if config.VNI != 0 {
+		if tag, err = allocateSegmentTag(config.PublicBridgeName, config.VNI); err != nil {
+			return err
+		}
+	}
+
+	// Create tunnels to peer clusters
+	if err := report.step("createPeerTunnels"); err != nil {
+		return err
+	}
+	bfd := config.Readiness != nil && config.Readiness.TunnelBfd
+	tunnels, err := ensurePeers(config.PublicBridgeName, config.Peers, config.VNI, tag, bfd)
+	if err != nil {
+		return err
+	}
+
+	// Stretch the network to the other nodes
+	if config.Overlay != nil {
+		if err := report.step("ensureOverlay"); err != nil {
+			return err
+		}
+		if err := ensureOverlay(config.PublicBridgeName, config.Overlay, config.VNI, tag); err != nil {
+			return err
+		}
+	}
+
+	// Create the network's tunnels and remove the ones no longer configured
+	if config.Mode == "" || config.Mode == ModeBridge {
+		if err := report.step("ensureTunnels"); err != nil {
+			return err
+		}
+		if err := ensureTunnels(config.PublicBridgeName, config.Name, config.Tunnels); err != nil {
+			return err
+		}
+		if len(config.GeneveOptions) > 0 {
+			if err := ensureGeneveTlvMap(config.PublicBridgeName, config.GeneveOptions); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Hold the pod back until its traffic can leave the node
+	if config.Readiness != nil {
+		if err := report.step("checkReadiness"); err != nil {
+			return err
+		}
+		if err := checkReadiness(config, tunnels); err != nil {
+			return err
+		}
+	}
+
+	// Create the mirror to the collector
+	if config.Mirror != nil {
+		if err := report.step("createMirror"); err != nil {
+			return err
+		}
+		if err := ensureMirror(config.PublicBridgeName, config.Mirror); err != nil {
+			return err
+		}
+	}
+
+	// Create the IPFIX collector for sampled pods
+	if config.Sampling != nil {
+		if err := report.step("createSamplingCollector"); err != nil {
+			return err
+		}
+		if err := ensureSamplingCollector(config.PublicBridgeName, config.Sampling); err != nil {
+			return err
+		}
+	}
+
+	// Converge an attachment that is in place rather than adding it again
+	if err := report.step("findAttachment"); err != nil {
+		return err
+	}
+	pod := loadPodArgs(config, args.Args)
+	existing, err := existingAttachment(config, args, pod)
+	if err != nil {
 		return err
 	}
+	if existing != nil {
+		return printChainedResult(config, existing)
+	}
 
 	// Get name space
-	netns, err := ns.GetNS(args.Netns)
+	if err := report.step("openNetns"); err != nil {
+		return err
+	}
+	netns, err := openNetns(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return err
 	}
 	defer netns.Close()
 
-	// Create veth
-	hostInterface, containerInterface, err := createVeth(netns, args.IfName)
+	// Create veth, undoing everything from here on if ADD fails
+	if err := report.step("createVeth"); err != nil {
+		return err
+	}
+	rollback = true
+	mac, err := requestedMAC(config, pod)
+	if err != nil {
+		return err
+	}
+	if mac != nil {
+		if err := checkMACInUse(mac, args.ContainerID); err != nil {
+			return err
+		}
+	}
+	hostInterface, containerInterface, err := createVeth(netns, key, args.IfName, config.IfNamePrefix, mac, config.MTU)
 	if err != nil {
 		return err
 	}
 
 	// Add port to OVS
-	if err := addOvsPort(config.PublicBridgeName, hostInterface.Name); err != nil {
+	if err := report.step("addPort"); err != nil {
+		return err
+	}
+	if err := dataplane.AddPort(config.PublicBridgeName, hostInterface.Name); err != nil {
+		return err
+	}
+	if err := setPodIdentity(hostInterface.Name, key, pod, containerInterface.Mac); err != nil {
+		return err
+	}
+
+	// Tag the port with what the operator's hooks look up for the pod
+	if len(config.MetadataHooks) > 0 {
+		if err := report.step("setPortMetadata"); err != nil {
+			return err
+		}
+		if err := setPortMetadata(config, hostInterface.Name, args.ContainerID, pod, containerInterface.Mac); err != nil {
+			return err
+		}
+	}
+
+	// Mirror the port's traffic
+	if config.Mirror != nil {
+		if err := addMirrorPort(config.Mirror, hostInterface.Name); err != nil {
+			return err
+		}
+	}
+
+	ofport, err := getOfport(hostInterface.Name)
+	if err != nil {
+		return err
+	}
+
+	// Isolate the port in its segment
+	if err := report.step("setupSegmentPort"); err != nil {
+		return err
+	}
+	if config.VNI != 0 {
+		if err := setPortTag(hostInterface.Name, tag); err != nil {
+			return err
+		}
+	}
+
+	// Install the flows of the features enabled on the port
+	if err := report.step("addPortFlows"); err != nil {
+		return err
+	}
+	flows, err := portFlows(config, pod, ofport, tunnels)
+	if err != nil {
+		return err
+	}
+	if err := dataplane.AddFlows(config.PublicBridgeName, flows...); err != nil {
 		return err
 	}
 
 	// Invoke IPAM
-	r, err := ipam.ExecAdd(config.IPAM.Type, args.StdinData)
+	if err := report.step("ipamAdd"); err != nil {
+		return err
+	}
+	result, err := execIpamAdd(config, key, args.StdinData)
 	if err != nil {
 		return err
 	}
+	report.ipamAdded()
 
-	// Convert IPAM result to current Result type
-	result, err := current.NewResultFromResult(r)
+	// Tag the port with the VLAN of its subnet
+	if len(config.SubnetVlans) > 0 {
+		if err := report.step("setSubnetVlan"); err != nil {
+			return err
+		}
+		vlan, err := subnetVlanTag(config.SubnetVlans, result)
+		if err != nil {
+			return err
+		}
+		if err := setPortTag(hostInterface.Name, vlan); err != nil {
+			return err
+		}
+		if err := ensureVlanTranslation(config.PublicBridgeName, key, config.VlanTranslations, vlan); err != nil {
+			return err
+		}
+	}
+
+	// Put the port in the VLAN the pod asked for, or the network's
+	vlan, err := portVlan(config, pod)
 	if err != nil {
 		return err
 	}
+	if vlan != 0 {
+		if err := report.step("setPortVlan"); err != nil {
+			return err
+		}
+		if config.VNI != 0 || len(config.SubnetVlans) > 0 {
+			return fmt.Errorf("pod VLANs cannot be used with vni or subnetVlans")
+		}
+		if err := setPortTag(hostInterface.Name, vlan); err != nil {
+			return err
+		}
+		if config.VlanUplink != "" {
+			if err := addVlanSubinterfacePort(config.PublicBridgeName, key, config.VlanUplink, vlan, vlan); err != nil {
+				return err
+			}
+		}
+	}
 
-	if len(result.IPs) == 0 {
-		return fmt.Errorf("IPAM plugin returns no IP address")
+	// Make the port a trunk for pods that tag their own traffic
+	if len(config.TrunkVlans) > 0 {
+		if err := report.step("setPortTrunk"); err != nil {
+			return err
+		}
+		if vlan != 0 {
+			return fmt.Errorf("pod VLANs cannot be used with trunkVlans")
+		}
+		if err := setPortTrunk(hostInterface.Name, config.TrunkVlans, config.NativeVlan); err != nil {
+			return err
+		}
+		if err := addTrunkVlanSubinterfacePorts(config, key); err != nil {
+			return err
+		}
 	}
 
-	// Associate all IPs to the first interface
-	for _, ip := range result.IPs {
-		ip.Interface = current.Int(0)
+	// Limit the pod's bandwidth as the runtime or its QoS profile asked
+	bw, minRate, err := podBandwidth(config, pod)
+	if err != nil {
+		return err
+	}
+	if bw != nil {
+		if err := report.step("setPortBandwidth"); err != nil {
+			return err
+		}
+		if err := setPortBandwidth(hostInterface.Name, bw, minRate); err != nil {
+			return err
+		}
+	}
+
+	// Keep the families the network wants, in the order it prefers
+	if err := selectIPs(config, result); err != nil {
+		return err
+	}
+	// ptp mode narrows the addresses to host routes, masquerading needs
+	// the subnets IPAM allocated them from
+	subnets := resultSubnets(result)
+	if config.IPv6Only {
+		if err := ipv6OnlyResult(result, config.Slaac != nil); err != nil {
+			return err
+		}
+	}
+	if config.Mode == ModePtp {
+		ptpResult(result)
+	} else {
+		dualStackResult(result)
+	}
+	if config.GatewayPort != "" {
+		gatewayResult(result)
+	}
+	if !isPrimaryNetwork(config) {
+		secondaryResult(result)
 	}
 
-	// Set interface in result
-	result.Interfaces = []*current.Interface{containerInterface}
+	// Set interface in result, with all IPs, of both families, on it
+	setContainerInterface(result, hostInterface, containerInterface)
 
 	// Apply IP address to the container interface
+	if err := report.step("configureInterface"); err != nil {
+		return err
+	}
+	skipIPConfig, err := pod.bool("skipIPConfig", config.SkipIPConfig)
+	if err != nil {
+		return err
+	}
+	var gatewayMAC net.HardwareAddr
+	if config.Mode == ModePtp {
+		link, err := bridgeLink(config.PublicBridgeName)
+		if err != nil {
+			return err
+		}
+		gatewayMAC = link.Attrs().HardwareAddr
+	}
 	err = netns.Do(func(_ ns.NetNS) error {
-		return ipam.ConfigureIface(containerInterface.Name, result)
+		if skipIPConfig {
+			// Whatever is behind the interface, e.g. a VM, configures itself
+			return nil
+		}
+		if config.IPv6Only {
+			if err := configureIPv6Only(config, containerInterface.Name); err != nil {
+				return err
+			}
+		}
+		if err := enableIPv6(containerInterface.Name, result); err != nil {
+			return err
+		}
+		if config.Mode == ModePtp {
+			err = configurePtpContainer(containerInterface.Name, result, gatewayMAC)
+		} else {
+			err = ipam.ConfigureIface(containerInterface.Name, result)
+		}
+		if err != nil {
+			return err
+		}
+		if config.Slaac != nil {
+			if err := waitForSlaac(containerInterface.Name, config.Slaac.Timeout, result); err != nil {
+				return err
+			}
+		}
+		return addExtraAddresses(config.ExtraAddresses, containerInterface.Name, netns.Path(), result)
 	})
 	if err != nil {
 		return err
 	}
 
+	// Route the container's addresses from the host
+	if config.Mode == ModePtp {
+		if err := report.step("setupPtpHost"); err != nil {
+			return err
+		}
+		if err := setupPtpHost(config.PublicBridgeName, hostInterface.Name, ofport, containerInterface, result); err != nil {
+			return err
+		}
+	}
+
+	// Let the host route for the containers
+	if config.IsGateway {
+		if err := report.step("setBridgeGateway"); err != nil {
+			return err
+		}
+		if err := setBridgeGateway(config.PublicBridgeName, result); err != nil {
+			return err
+		}
+	}
+	if config.GatewayPort != "" {
+		if err := report.step("ensureGatewayPort"); err != nil {
+			return err
+		}
+		if err := ensureGatewayPort(config.PublicBridgeName, config.GatewayPort, config.MTU, result); err != nil {
+			return err
+		}
+	}
+	if config.IPMasq {
+		if err := report.step("setupIPMasq"); err != nil {
+			return err
+		}
+		if err := setupIPMasq(config, args.ContainerID, subnets); err != nil {
+			return err
+		}
+	}
+	if len(config.RuntimeConfig.PortMappings) > 0 {
+		if err := report.step("setupHostPorts"); err != nil {
+			return err
+		}
+		if err := setupHostPorts(config, args.ContainerID, config.RuntimeConfig.PortMappings, result); err != nil {
+			return err
+		}
+	}
+
 	// Set DNS in result
-	result.DNS = config.DNS
+	if isPrimaryNetwork(config) {
+		result.DNS = config.DNS
+	}
 
-	// Update JSON file
-	readHostInterfacesFromFile()
-	hostInterfaces[args.ContainerID] = hostInterface.Name
-	writeHostInterfacesToFile()
+	// Update JSON file, which has the host veth since it was named
+	if err := report.step("saveState"); err != nil {
+		return err
+	}
+	if err := cacheResult(config.Name, args, result); err != nil {
+		return err
+	}
+	if err := recordAddresses(key, result); err != nil {
+		return err
+	}
+	if err := recordPodArgs(key, pod); err != nil {
+		return err
+	}
 
-	return types.PrintResult(result, config.NetConf.CNIVersion)
+	return printChainedResult(config, result)
 }
 
-func cmdDel(args *skel.CmdArgs) error {
-	config := &RainierConfig{}
-	if err := json.Unmarshal(args.StdinData, config); err != nil {
+func cmdDel(args *skel.CmdArgs) (err error) {
+	config, err := loadConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	config, stdinData := addedConfig(config, args)
+	report := newReport(config.ReportDir, "DEL", args, config.Name)
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	defer func() {
+		report.finish(err)
+	}()
+	if err := migrateLegacyState(config.Name, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	// Leave the dataplane alone during maintenance
+	if err := report.step("checkMaintenance"); err != nil {
+		return err
+	}
+	if err := maintenanceMode(); err != nil {
+		return err
+	}
+
+	// Back off while OVS is failing
+	if err := report.step("checkBreaker"); err != nil {
+		return err
+	}
+	if err := breakerOpen(); err != nil {
+		return err
+	}
+
+	// Wait for a turn to change the dataplane
+	if err := report.step("acquireSlot"); err != nil {
 		return err
 	}
+	release, err := acquireSlot(config.MaxConcurrency)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	if err := ipam.ExecDel(config.IPAM.Type, args.StdinData); err != nil {
+	// Use the mode the container was added with
+	if err := report.step("selectMode"); err != nil {
 		return err
 	}
+	if err := selectMode(config, key, false); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			forgetMode(key)
+			forgetCachedResult(config.Name, args.ContainerID, args.IfName)
+		}
+	}()
+
+	// Tear down whatever is there even when a step fails, keeping the
+	// records of what could not be removed for the runtime to retry
+	failed := &teardownErrors{}
 
-	// Update JSON file and remove port from OVS
-	readHostInterfacesFromFile()
-	hostIfName := hostInterfaces[args.ContainerID]
-	if hostIfName != nil {
-		if err := deleteOvsPort(config.PublicBridgeName, hostIfName.(string)); err != nil {
+	// Release IP addresses
+	if err := report.step("ipamDel"); err != nil {
+		return err
+	}
+	if config.IPAM.Type != "" {
+		failed.add("ipamDel", ipam.ExecDel(config.IPAM.Type, stdinData))
+	}
+	readAddressesFromFile()
+	owned := addresses[key]
+	natRemoved := true
+	if len(config.RuntimeConfig.PortMappings) > 0 {
+		natRemoved = failed.add("teardownHostPorts", teardownHostPorts(config, args.ContainerID)) && natRemoved
+	}
+	if config.IPMasq {
+		natRemoved = failed.add("teardownIPMasq", teardownIPMasq(config, args.ContainerID, owned)) && natRemoved
+	}
+	if config.Mode == ModePtp {
+		natRemoved = failed.add("teardownPtpHost", teardownPtpHost(config.PublicBridgeName, owned)) && natRemoved
+	}
+	if natRemoved {
+		forgetAddresses(key)
+	}
+
+	// Give a host NIC back to the host
+	if config.Mode == ModeHostDevice {
+		if err := report.step("releaseDevice"); err != nil {
 			return err
 		}
-		delete(hostInterfaces, args.ContainerID)
-		writeHostInterfacesToFile()
+		failed.add("releaseDevice", releaseHostDevice(config, args))
+		return failed.err()
 	}
 
-	return nil
+	// Delete the container's macvlan or ipvlan link
+	if config.Mode == ModeMacvlan || config.Mode == ModeIpvlan {
+		if err := report.step("deleteLink"); err != nil {
+			return err
+		}
+		failed.add("deleteLink", deleteLink(config, args))
+		return failed.err()
+	}
+
+	// Remove the port from OVS and update JSON file
+	if err := report.step("deletePort"); err != nil {
+		return err
+	}
+	hostIfName, err := attachedInterface(config, args.ContainerID, args.IfName)
+	failed.add("findPort", err)
+	if hostIfName != "" {
+		removed := true
+		if ofport, err := getOfport(hostIfName); err == nil {
+			removed = failed.add("deletePortFlows", dataplane.DeletePortFlows(config.PublicBridgeName, ofport)) && removed
+			if config.NeighborRateLimit != nil {
+				removed = failed.add("deleteNeighborMeter", deleteNeighborMeter(config.PublicBridgeName, ofport)) && removed
+			}
+		}
+		removed = failed.add("clearPortBandwidth", clearPortBandwidth(hostIfName)) && removed
+		removed = failed.add("deletePort", dataplane.DeletePort(config.PublicBridgeName, hostIfName)) && removed
+
+		// The container end goes with the host end, unless the container's
+		// namespace took both with it already
+		if err := report.step("deleteVeth"); err != nil {
+			return err
+		}
+		if link, err := netlink.LinkByName(hostIfName); err == nil {
+			removed = failed.add("deleteVeth", netlink.LinkDel(link)) && removed
+		}
+		if removed {
+			failed.add("forgetPort", forgetHostInterface(key))
+		}
+	}
+	forgetPodArgs(key)
+
+	// Delete the VLAN ports no other container needs any more
+	if err := report.step("releaseVlanPorts"); err != nil {
+		return err
+	}
+	failed.add("releaseVlanPorts", releaseContainerVlanPorts(key))
+
+	// Release the network's segment once its last port is gone
+	if config.VNI != 0 {
+		if err := report.step("releaseSegment"); err != nil {
+			return err
+		}
+		failed.add("releaseSegment", releaseSegment(config))
+	}
+
+	return failed.err()
+}
+
+func releaseSegment(config *RainierConfig) error {
+	unlock, err := lockPorts(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return releaseSegmentTag(config.PublicBridgeName, config.VNI)
+}
+
+func releaseContainerVlanPorts(key string) error {
+	unlock, err := lockPorts(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return releaseVlanPorts(key)
+}
+
+// teardownErrors collects the failures of a teardown that carries on past
+// them
+type teardownErrors []string
+
+// add records err, if any, and tells whether the step succeeded
+func (e *teardownErrors) add(step string, err error) bool {
+	if err == nil {
+		return true
+	}
+	*e = append(*e, fmt.Sprintf("%s: %v", step, err))
+	return false
 }
 
-func cmdGet(args *skel.CmdArgs) error {
-	return fmt.Errorf("cmdGet is not implemented")
+func (e *teardownErrors) err() error {
+	if len(*e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("teardown failed in part: %s", strings.Join(*e, "; "))
 }
 
-func createVeth(netns ns.NetNS, ifName string) (*current.Interface, *current.Interface, error) {
+func cmdCheck(args *skel.CmdArgs) error {
+	config, err := loadConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	cached, err := readCachedAttachment(config.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	var result *current.Result
+	if config.RawPrevResult == nil && cached != nil {
+		result = cached.Result
+	} else if result, err = parsePrevResult(config); err != nil {
+		return err
+	}
+	result = containerResult(result, args.IfName)
+	if err := migrateLegacyState(config.Name, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+	if err := selectMode(config, attachmentKey(config.Name, args.ContainerID, args.IfName), false); err != nil {
+		return err
+	}
+
+	netns, err := openNetns(args.Netns)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	// Follow the container interface if it was renamed
+	hostIfName, err := attachedInterface(config, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	attached := hostIfName != ""
+	ifName := args.IfName
+	if attached && config.Mode != ModeHostDevice {
+		ifName = containerVethName(netns, hostIfName, args.IfName)
+	}
+
+	// Check addresses, routes and gateways of every address family, unless
+	// the interface was left for someone else to configure
+	problems := []string{}
+	if cached != nil {
+		problems = append(problems, compareResults(containerResult(cached.Result, args.IfName), result)...)
+	}
+	pod := loadPodArgs(config, args.Args)
+	skipIPConfig, err := pod.bool("skipIPConfig", config.SkipIPConfig)
+	if err != nil {
+		return err
+	}
+	if !skipIPConfig {
+		err = netns.Do(func(_ ns.NetNS) error {
+			problems = append(problems, checkContainerRoutes(ifName, result, isPrimaryNetwork(config))...)
+			problems = append(problems, checkContainerAddresses(ifName, result)...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check both ends of the veth agree on the MTU and the port has not
+	// drifted, repairing the port when asked to unless in maintenance
+	if attached && config.Mode != ModeHostDevice {
+		repair := config.SelfHeal && maintenanceMode() == nil
+		problems = append(problems, checkVethMTU(netns, ifName, hostIfName)...)
+		problems = append(problems, checkPort(config, pod, attachmentKey(config.Name, args.ContainerID, args.IfName), hostIfName, result, repair)...)
+	}
+
+	// Check the NAT and forwarding rules are still there, which a firewalld
+	// reload flushes
+	if attached && config.Mode != ModeHostDevice {
+		repair := config.SelfHeal && maintenanceMode() == nil
+		if config.IPMasq {
+			problems = append(problems, checkIPMasq(config, args.ContainerID, result, repair)...)
+		}
+		if len(config.RuntimeConfig.PortMappings) > 0 {
+			problems = append(problems, checkHostPorts(config, args.ContainerID, config.RuntimeConfig.PortMappings, result, repair)...)
+		}
+	}
+
+	// Check no other controller took over rainier's priorities
+	if attached && config.Mode != ModeHostDevice {
+		problems = append(problems, checkReservedFlows(config.PublicBridgeName)...)
+	}
+
+	// Check the host can reach the container over each of its families
+	if attached && (config.Mode == "" || config.Mode == ModeBridge) {
+		gateway := config.PublicBridgeName
+		if config.GatewayPort != "" {
+			gateway = config.GatewayPort
+		}
+		problems = append(problems, checkBridgeFamilies(gateway, result)...)
+	}
+
+	return checkProblems(problems)
+}
+
+// validateMTU defaults the MTU of the veth pair. Overlay networks need room
+// for the tunnel header below the uplink's MTU, which rainier leaves to the
+// operator to work out.
+func validateMTU(config *RainierConfig) error {
+	if config.MTU == 0 {
+		config.MTU = DefaultMTU
+	}
+	if config.MTU < MinMTU || config.MTU > MaxMTU {
+		return fmt.Errorf("invalid mtu %d, must be within %d-%d", config.MTU, MinMTU, MaxMTU)
+	}
+	if config.IPv6Only && config.MTU < MinIPv6MTU {
+		return fmt.Errorf("mtu %d is below the IPv6 minimum of %d", config.MTU, MinIPv6MTU)
+	}
+	return nil
+}
+
+func createVeth(netns ns.NetNS, key string, ifName string, ifNamePrefix string, mac net.HardwareAddr, mtu int) (*current.Interface, *current.Interface, error) {
+	hostName, err := reserveHostVeth(key)
+	if err != nil {
+		return nil, nil, err
+	}
 	contIface := &current.Interface{}
-	hostIface := &current.Interface{}
+	hostIface := &current.Interface{Name: hostName}
+
+	// Remove what a failed attempt for the same attachment left behind
+	if link, err := netlink.LinkByName(hostIface.Name); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, nil, fmt.Errorf("failed to delete stale veth %s: %v", hostIface.Name, err)
+		}
+	}
 
-	err := netns.Do(func(hostNS ns.NetNS) error {
+	err = netns.Do(func(hostNS ns.NetNS) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, DefaultMTU, hostNS)
+		hostVeth, containerVeth, err := setupContainerVeth(ifName, ifNamePrefix, mtu, hostNS)
 		if err != nil {
 			return err
 		}
 		contIface.Name = containerVeth.Name
 		contIface.Mac = containerVeth.HardwareAddr.String()
 		contIface.Sandbox = netns.Path()
-		hostIface.Name = hostVeth.Name
-		return nil
+		if mac != nil {
+			if err := setLinkMAC(containerVeth.Name, mac); err != nil {
+				return err
+			}
+			contIface.Mac = mac.String()
+		}
+
+		// Give the host end its rainier name
+		return hostNS.Do(func(_ ns.NetNS) error {
+			return renameLink(hostVeth.Name, hostIface.Name)
+		})
 	})
 
 	if err != nil {
@@ -149,26 +1068,33 @@ func createVeth(netns ns.NetNS, ifName string) (*current.Interface, *current.Int
 	return hostIface, contIface, nil
 }
 
-func createOvsBr(bridgeName string) error {
-	protocols := []string{ovs.ProtocolOpenFlow13}
-	client := ovs.New(
-		ovs.Sudo(),
-		ovs.Protocols(protocols),
-	)
+func renameLink(curName string, newName string) error {
+	link, err := netlink.LinkByName(curName)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %v", curName, err)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %s down: %v", curName, err)
+	}
+	if err := netlink.LinkSetName(link, newName); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", curName, newName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %s up: %v", newName, err)
+	}
+	return nil
+}
 
+func createOvsBr(bridgeName string) error {
+	client := ovsClient()
 	if err := client.VSwitch.AddBridge(bridgeName); err != nil {
 		return fmt.Errorf("Failed to add bridge %s. Error = %s", bridgeName, err)
 	}
-	return nil
+	return ensureBridgeProtocols(bridgeName)
 }
 
 func addOvsPort(bridgeName string, hostIfName string) error {
-	protocols := []string{ovs.ProtocolOpenFlow13}
-	client := ovs.New(
-		ovs.Sudo(),
-		ovs.Protocols(protocols),
-	)
-
+	client := ovsClient()
 	if err := client.VSwitch.AddPort(bridgeName, hostIfName); err != nil {
 		return fmt.Errorf("Failed to add port %s to bridge %s. Error = %s", hostIfName, bridgeName, err)
 	}
@@ -176,38 +1102,29 @@ func addOvsPort(bridgeName string, hostIfName string) error {
 }
 
 func deleteOvsPort(bridgeName string, hostIfName string) error {
-	protocols := []string{ovs.ProtocolOpenFlow13}
-	client := ovs.New(
-		ovs.Sudo(),
-		ovs.Protocols(protocols),
-	)
-
+	client := ovsClient()
 	if err := client.VSwitch.DeletePort(bridgeName, hostIfName); err != nil {
-		fmt.Println("%s %s", bridgeName, hostIfName)
 		return fmt.Errorf("Failed to delete port %s from bridge %s. Error = %s", hostIfName, bridgeName, err)
 	}
 	return nil
 }
 
 func readHostInterfacesFromFile() error {
-	jsonByte, err := ioutil.ReadFile(HostInterfaceJson)
-	if err == nil {
-		if err := json.Unmarshal(jsonByte, &hostInterfaces); err != nil {
-			return fmt.Errorf("Fail to decode host interface JSON")
-		}
-	}
-	return nil
+	return readState(HostInterfaceJson, &hostInterfaces)
 }
 
-func writeHostInterfacesToFile() error {
-	jsonByte, err := json.Marshal(hostInterfaces)
-	if err != nil {
-		return fmt.Errorf("Fail to encode host interface JSON")
-	}
-	if err := ioutil.WriteFile(HostInterfaceJson, jsonByte, 0644); err != nil {
-		return fmt.Errorf("Fail to write host interface JSON")
-	}
-	return nil
+func recordHostInterface(key string, name string) error {
+	return updateState(HostInterfaceJson, &hostInterfaces, func() error {
+		hostInterfaces[key] = name
+		return nil
+	})
+}
+
+func forgetHostInterface(key string) error {
+	return updateState(HostInterfaceJson, &hostInterfaces, func() error {
+		delete(hostInterfaces, key)
+		return nil
+	})
 }
 
 func init() {
@@ -218,6 +1135,22 @@ func init() {
 }
 
 func main() {
-	about := "Rainier CNI"
-	skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.All, about)
+	if isSubcommand() {
+		if err := runSubcommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	skel.PluginMainFuncs(pluginFuncs(), versionInfo{version.All}, about())
+}
+
+func pluginFuncs() skel.CNIFuncs {
+	return skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}
 }
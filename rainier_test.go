@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// The commands have to reach rainier through skel the way main runs it, not
+// only when called directly
+func TestPluginDispatch(t *testing.T) {
+	conf := `{"cniVersion": "1.1.0", "name": "net", "type": "rainier", "vni": 99999999}`
+	for _, command := range []string{"CHECK", "STATUS", "GC"} {
+		t.Run(command, func(t *testing.T) {
+			stdin := filepath.Join(t.TempDir(), "conf")
+			if err := ioutil.WriteFile(stdin, []byte(conf), 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(stdin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			saved := os.Stdin
+			os.Stdin = f
+			defer func() { os.Stdin = saved }()
+
+			t.Setenv("CNI_COMMAND", command)
+			t.Setenv("CNI_CONTAINERID", "ctr")
+			t.Setenv("CNI_NETNS", "/var/run/netns/ctr")
+			t.Setenv("CNI_IFNAME", "eth0")
+			t.Setenv("CNI_PATH", "/opt/cni/bin")
+
+			e := skel.PluginMainFuncsWithError(pluginFuncs(), versionInfo{version.All}, about())
+			if e == nil {
+				t.Fatalf("%s of an invalid configuration succeeded", command)
+			}
+			if !strings.Contains(e.Error(), "invalid vni 99999999") {
+				t.Errorf("%s did not reach rainier: %v", command, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// Readiness keeps pods from starting on a network that would blackhole their
+// traffic, e.g. during node bring-up. ADD fails with a retryable error until
+// the uplink has carrier and, with TunnelBfd, BFD is up on every tunnel to a
+// peer.
+type Readiness struct {
+	UplinkCarrier bool `json:"uplinkCarrier"`
+	TunnelBfd     bool `json:"tunnelBfd"`
+}
+
+func validateReadiness(config *RainierConfig) error {
+	r := config.Readiness
+	if r == nil {
+		return nil
+	}
+	if r.UplinkCarrier && config.Uplink == "" {
+		return fmt.Errorf("readiness uplinkCarrier needs an uplink")
+	}
+	if r.TunnelBfd && len(config.Peers) == 0 {
+		return fmt.Errorf("readiness tunnelBfd needs peers")
+	}
+	return nil
+}
+
+func checkReadiness(config *RainierConfig, tunnels []peerTunnel) error {
+	r := config.Readiness
+	notReady := []string{}
+	if r.UplinkCarrier {
+		link, err := netlink.LinkByName(config.Uplink)
+		if err != nil {
+			return fmt.Errorf("failed to find uplink %s: %v", config.Uplink, err)
+		}
+		if link.Attrs().OperState != netlink.OperUp {
+			notReady = append(notReady, fmt.Sprintf("uplink %s is %s", config.Uplink, link.Attrs().OperState))
+		}
+	}
+	if r.TunnelBfd {
+		for _, tunnel := range tunnels {
+			portName := peerPortName(tunnel.peer, config.VNI)
+			state, err := vsctl("get", "interface", portName, "bfd_status:state")
+			if err != nil {
+				state = "unknown"
+			}
+			if state = strings.Trim(state, `"`); state != "up" {
+				notReady = append(notReady, fmt.Sprintf("BFD to peer %s is %s", tunnel.peer.Name, state))
+			}
+		}
+	}
+	if len(notReady) == 0 {
+		return nil
+	}
+	return &types.Error{
+		Code:    ErrTryAgainLater,
+		Msg:     "network is not ready, try again later",
+		Details: strings.Join(notReady, "; "),
+	}
+}
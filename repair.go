@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+)
+
+// checkPort looks for drift of a container's OVS port that can be repaired
+// without recreating the pod: the port was removed from the bridge, or flows
+// rainier installed for it are missing. With repair set the drift is fixed
+// instead of reported. A missing host veth is not repairable.
+func checkPort(config *RainierConfig, pod podArgs, key string, hostIfName string, result *current.Result, repair bool) []string {
+	problems := []string{}
+	if _, err := netlink.LinkByName(hostIfName); err != nil {
+		// Reported by checkVethMTU
+		return problems
+	}
+
+	bridgeName, err := vsctl("port-to-br", hostIfName)
+	if err != nil || bridgeName != config.PublicBridgeName {
+		if !repair {
+			return append(problems, fmt.Sprintf("port %s is not attached to bridge %s", hostIfName, config.PublicBridgeName))
+		}
+		if err := reattachPort(config, pod, key, hostIfName, result); err != nil {
+			return append(problems, err.Error())
+		}
+	}
+
+	ofport, err := getOfport(hostIfName)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	tunnels, err := peerTunnels(config.Peers, config.VNI)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	flows, err := portFlows(config, pod, ofport, tunnels)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	present, err := countPortFlows(config.PublicBridgeName, ofport)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if present < len(flows) {
+		if !repair {
+			return append(problems, fmt.Sprintf("port %s has %d of its %d flows", hostIfName, present, len(flows)))
+		}
+		// Adding a flow that is there only resets its counters. Replacing the
+		// port's flows instead would also remove the ones installed outside
+		// ADD, such as a quarantine.
+		if err := dataplane.AddFlows(config.PublicBridgeName, flows...); err != nil {
+			return append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// reattachPort adds the host veth back to the bridge and restores what ADD
+// configured on its port
+func reattachPort(config *RainierConfig, pod podArgs, key string, hostIfName string, result *current.Result) error {
+	if err := dataplane.AddPort(config.PublicBridgeName, hostIfName); err != nil {
+		return err
+	}
+	if err := setPodIdentity(hostIfName, key, pod, containerMAC(result)); err != nil {
+		return err
+	}
+	if len(config.MetadataHooks) > 0 {
+		if err := setPortMetadata(config, hostIfName, keyContainerID(key), pod, containerMAC(result)); err != nil {
+			return err
+		}
+	}
+	if config.VNI != 0 {
+		tag, err := allocateSegmentTag(config.PublicBridgeName, config.VNI)
+		if err != nil {
+			return err
+		}
+		if err := setPortTag(hostIfName, tag); err != nil {
+			return err
+		}
+	}
+	if len(config.SubnetVlans) > 0 {
+		vlan, err := subnetVlanTag(config.SubnetVlans, result)
+		if err != nil {
+			return err
+		}
+		if err := setPortTag(hostIfName, vlan); err != nil {
+			return err
+		}
+	}
+	vlan, err := portVlan(config, pod)
+	if err != nil {
+		return err
+	}
+	if vlan != 0 {
+		if err := setPortTag(hostIfName, vlan); err != nil {
+			return err
+		}
+	}
+	if len(config.TrunkVlans) > 0 {
+		if err := setPortTrunk(hostIfName, config.TrunkVlans, config.NativeVlan); err != nil {
+			return err
+		}
+	}
+	bw, minRate, err := podBandwidth(config, pod)
+	if err != nil {
+		return err
+	}
+	if bw != nil {
+		if err := setPortBandwidth(hostIfName, bw, minRate); err != nil {
+			return err
+		}
+	}
+	if config.Mirror != nil {
+		if err := addMirrorPort(config.Mirror, hostIfName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countPortFlows(bridgeName string, ofport int) (int, error) {
+	cookie := flowCookie(0, uint32(ofport))
+	match := fmt.Sprintf("cookie=%#x/%#x", cookie, cookieMagicMask|cookieOwnerMask)
+	out, err := ofctl("dump-flows", bridgeName, match)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to dump flows of port %d from bridge %s. Error = %s", ofport, bridgeName, err)
+	}
+	return strings.Count(out, "cookie="), nil
+}
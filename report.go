@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// opReport records the steps of one ADD or DEL with their durations and
+// outcome, and writes them to the report directory, if there is one, when
+// the operation ends so that they can be attached to bug reports. Steps are marked in order and
+// each one ends when the next begins; a failing operation fails its last step.
+// Steps are where FaultsEnv injects faults and where the deadline is
+// enforced, with or without a report.
+type opReport struct {
+	Command     string       `json:"command"`
+	ContainerID string       `json:"containerID"`
+	IfName      string       `json:"ifName"`
+	Netns       string       `json:"netns"`
+	Network     string       `json:"network"`
+	Start       time.Time    `json:"start"`
+	Duration    string       `json:"duration"`
+	Error       string       `json:"error,omitempty"`
+	Steps       []reportStep `json:"steps"`
+
+	dir       string
+	stepStart time.Time
+	ipamDone  bool
+}
+
+type reportStep struct {
+	Name     string `json:"name"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newReport(dir string, command string, args *skel.CmdArgs, network string) *opReport {
+	return &opReport{
+		Command:     command,
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Netns:       args.Netns,
+		Network:     network,
+		Start:       time.Now(),
+		dir:         dir,
+	}
+}
+
+// step ends the previous step and begins name, unless a fault injected at
+// name or the deadline fails the operation there
+func (r *opReport) step(name string) error {
+	r.endStep(nil)
+	r.Steps = append(r.Steps, reportStep{Name: name})
+	r.stepStart = time.Now()
+	if err := injectFault(name); err != nil {
+		return err
+	}
+	return checkDeadline(name)
+}
+
+// ipamAdded marks that IPAM gave the container its addresses, which a
+// rollback then has to release
+func (r *opReport) ipamAdded() {
+	r.ipamDone = true
+}
+
+func (r *opReport) endStep(err error) {
+	if len(r.Steps) == 0 || r.Steps[len(r.Steps)-1].Duration != "" {
+		return
+	}
+	last := &r.Steps[len(r.Steps)-1]
+	last.Duration = time.Since(r.stepStart).String()
+	if err != nil {
+		last.Error = err.Error()
+	}
+}
+
+// finish never fails the operation; a report that cannot be written is
+// only mentioned on stderr
+func (r *opReport) finish(err error) {
+	if r.dir == "" {
+		return
+	}
+	r.endStep(err)
+	r.Duration = time.Since(r.Start).String()
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	jsonByte, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		name := fmt.Sprintf("%s-%s-%s.json", r.Start.UTC().Format("20060102T150405.000000000"), r.Command, shortID(r.ContainerID))
+		if err = os.MkdirAll(r.dir, 0755); err == nil {
+			err = ioutil.WriteFile(filepath.Join(r.dir, name), jsonByte, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rainier: failed to write operation report: %v\n", err)
+	}
+}
+
+func shortID(containerID string) string {
+	if len(containerID) > 12 {
+		return containerID[:12]
+	}
+	return containerID
+}
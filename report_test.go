@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestReportStepFaults(t *testing.T) {
+	t.Setenv(FaultsEnv, "addPort=fail,ipamAdd=retry")
+	report := newReport("", "ADD", &skel.CmdArgs{ContainerID: "ctr", IfName: "eth0"}, "net")
+	if err := report.step("createVeth"); err != nil {
+		t.Errorf("step(createVeth) = %v, want no fault", err)
+	}
+	if err := report.step("addPort"); err == nil {
+		t.Errorf("step(addPort) succeeded, want the injected failure")
+	}
+	err := report.step("ipamAdd")
+	if e, ok := err.(*types.Error); !ok || e.Code != ErrTryAgainLater {
+		t.Errorf("step(ipamAdd) = %v, want a retryable error", err)
+	}
+	if report.ipamDone {
+		t.Errorf("IPAM is marked done before it ran")
+	}
+	report.finish(err)
+}
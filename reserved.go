@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Priorities 1-999 of table 0 are rainier's. Other controllers and the
+// flows configured in rainier's netconf may use priority 0 for table-miss
+// behaviour, 1000 and above to take precedence over rainier, and any other
+// table. Cookies with rainier's magic in the top 16 bits are rainier's too.
+const (
+	ReservedPriorityMin = 1
+	ReservedPriorityMax = 999
+	DefaultFlowPriority = 32768
+)
+
+// flowField returns the value of a key=value field of a flow, in the syntax
+// of both ovs-ofctl add-flow and dump-flows
+func flowField(flow string, key string) (string, bool) {
+	for _, field := range strings.FieldsFunc(flow, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.HasPrefix(field, key+"=") {
+			return strings.TrimPrefix(field, key+"="), true
+		}
+	}
+	return "", false
+}
+
+// reservedFlow tells whether a flow's table and priority fall in the range
+// reserved for rainier
+func reservedFlow(flow string) (bool, error) {
+	if table, ok := flowField(flow, "table"); ok && table != "0" {
+		return false, nil
+	}
+	priority := DefaultFlowPriority
+	if value, ok := flowField(flow, "priority"); ok {
+		var err error
+		if priority, err = strconv.Atoi(value); err != nil {
+			return false, fmt.Errorf("invalid priority %q", value)
+		}
+	}
+	return priority >= ReservedPriorityMin && priority <= ReservedPriorityMax, nil
+}
+
+func validateFlowTemplate(flow string) error {
+	reserved, err := reservedFlow(flow)
+	if err != nil {
+		return fmt.Errorf("flow %q: %v", flow, err)
+	}
+	if reserved {
+		return fmt.Errorf("flow %q uses a priority within %d-%d of table 0, which is reserved for rainier",
+			flow, ReservedPriorityMin, ReservedPriorityMax)
+	}
+	return nil
+}
+
+// checkReservedFlows reports flows of other controllers in rainier's range
+func checkReservedFlows(bridgeName string) []string {
+	out, err := ofctl("dump-flows", bridgeName, "table=0")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		value, ok := flowField(line, "cookie")
+		if !ok {
+			continue
+		}
+		cookie, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+		if err == nil && cookie&cookieMagicMask == cookieMagic<<cookieMagicShift {
+			continue
+		}
+		if reserved, err := reservedFlow(line); err == nil && reserved {
+			problems = append(problems, fmt.Sprintf("foreign flow in rainier's priority range on %s: %s", bridgeName, strings.TrimSpace(line)))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	types040 "github.com/containernetworking/cni/pkg/types/040"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/vishvananda/netlink"
+)
+
+const ResultCacheDir = StateDir + "/results"
+
+// ADD caches its network configuration and result per attachment, as libcni
+// does in /var/lib/cni. DEL tears down what ADD set up with the
+// configuration it was added with, even when the runtime's has changed
+// since, e.g. port mappings or the IPAM range. CHECK falls back to the
+// cached result when the runtime passes none and reports addresses the
+// runtime's prevResult and the cached result disagree on. Results are kept
+// in a directory per network and container, as none of the names can hold
+// a '/' while each of them can hold a '-'.
+type cachedAttachment struct {
+	ContainerID string          `json:"containerID"`
+	IfName      string          `json:"ifName"`
+	Config      json.RawMessage `json:"config"`
+	Result      *current.Result `json:"result"`
+}
+
+func resultCachePath(network string, containerID string, ifName string) string {
+	return filepath.Join(ResultCacheDir, network, containerID, ifName)
+}
+
+func cacheResult(network string, args *skel.CmdArgs, result *current.Result) error {
+	if result.CNIVersion == "" {
+		result.CNIVersion = current.ImplementedSpecVersion
+	}
+	dir := filepath.Dir(resultCachePath(network, args.ContainerID, args.IfName))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Fail to create %s. Error = %s", dir, err)
+	}
+	attachment := &cachedAttachment{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Config:      args.StdinData,
+		Result:      result,
+	}
+	return writeState(resultCachePath(network, args.ContainerID, args.IfName), attachment)
+}
+
+// readCachedAttachment returns nil when the attachment has no cached result,
+// e.g. when it was added by an older version. Versions built with CNI 0.4.0
+// cached results of that version, which are converted.
+func readCachedAttachment(network string, containerID string, ifName string) (*cachedAttachment, error) {
+	path := resultCachePath(network, containerID, ifName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	stored := &struct {
+		cachedAttachment
+		Result json.RawMessage `json:"result"`
+	}{}
+	if err := readState(path, stored); err != nil {
+		return nil, err
+	}
+	attachment := &stored.cachedAttachment
+	if stored.Result == nil {
+		return attachment, nil
+	}
+	result, err := decodeCachedResult(stored.Result)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to decode cached result of %s: %v", path, err)
+	}
+	attachment.Result = result
+	return attachment, nil
+}
+
+func decodeCachedResult(raw json.RawMessage) (*current.Result, error) {
+	resultVersion := struct {
+		CNIVersion string `json:"cniVersion"`
+	}{}
+	if err := json.Unmarshal(raw, &resultVersion); err != nil {
+		return nil, err
+	}
+	if resultVersion.CNIVersion == "" {
+		// Results ADD built itself went without a version
+		legacy := &types040.Result{}
+		if err := json.Unmarshal(raw, legacy); err != nil {
+			return nil, err
+		}
+		legacy.CNIVersion = types040.ImplementedSpecVersion
+		return current.NewResultFromResult(legacy)
+	}
+	r, err := version.NewResult(resultVersion.CNIVersion, raw)
+	if err != nil {
+		return nil, err
+	}
+	return current.NewResultFromResult(r)
+}
+
+// forgetCachedResult also removes the container's directory once it is
+// empty
+func forgetCachedResult(network string, containerID string, ifName string) {
+	path := resultCachePath(network, containerID, ifName)
+	os.Remove(path)
+	os.Remove(filepath.Dir(path))
+}
+
+// existingAttachment returns the cached result of an attachment whose veth
+// and state are still in place, after converging its port to the
+// configuration as CHECK does with selfHeal. A repeated ADD, e.g. retried by
+// kubelet after its timeout, then neither fails nor gets a second veth or
+// address. Host devices and macvlan or ipvlan links are always added again.
+func existingAttachment(config *RainierConfig, args *skel.CmdArgs, pod podArgs) (*current.Result, error) {
+	if config.Mode != "" && config.Mode != ModeBridge && config.Mode != ModePtp {
+		return nil, nil
+	}
+	attachment, err := readCachedAttachment(config.Name, args.ContainerID, args.IfName)
+	if err != nil || attachment == nil {
+		return nil, err
+	}
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	readHostInterfacesFromFile()
+	hostIfName, ok := hostInterfaces[key].(string)
+	if !ok {
+		return nil, nil
+	}
+	link, err := netlink.LinkByName(hostIfName)
+	if err != nil || peerInHostNamespace(link) {
+		return nil, nil
+	}
+	if problems := checkPort(config, pod, key, hostIfName, attachment.Result, true); len(problems) > 0 {
+		return nil, fmt.Errorf("failed to converge port %s: %s", hostIfName, strings.Join(problems, "; "))
+	}
+	return attachment.Result, nil
+}
+
+// compareResults reports the container addresses that only one of the
+// results has
+func compareResults(cached *current.Result, result *current.Result) []string {
+	addresses := func(r *current.Result) map[string]bool {
+		set := make(map[string]bool)
+		for _, ipc := range r.IPs {
+			set[ipc.Address.String()] = true
+		}
+		return set
+	}
+	added, passed := addresses(cached), addresses(result)
+	problems := []string{}
+	for address := range added {
+		if !passed[address] {
+			problems = append(problems, fmt.Sprintf("address %s of ADD's result is missing from prevResult", address))
+		}
+	}
+	for address := range passed {
+		if !added[address] {
+			problems = append(problems, fmt.Sprintf("address %s of prevResult was not given by ADD", address))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// addedConfig returns the configuration the container was added with, and
+// the stdin data it came from, when ADD cached it
+func addedConfig(config *RainierConfig, args *skel.CmdArgs) (*RainierConfig, []byte) {
+	attachment, err := readCachedAttachment(config.Name, args.ContainerID, args.IfName)
+	if err != nil || attachment == nil {
+		return config, args.StdinData
+	}
+	added, err := loadConfig(attachment.Config)
+	if err != nil {
+		return config, args.StdinData
+	}
+	return added, attachment.Config
+}
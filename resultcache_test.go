@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+func resultOf(cidrs ...string) *current.Result {
+	result := &current.Result{}
+	for _, cidr := range cidrs {
+		ip, ipnet, _ := net.ParseCIDR(cidr)
+		ipnet.IP = ip
+		result.IPs = append(result.IPs, &current.IPConfig{Address: *ipnet})
+	}
+	return result
+}
+
+func TestCompareResults(t *testing.T) {
+	tests := []struct {
+		cached *current.Result
+		result *current.Result
+		want   []string
+	}{
+		{resultOf("10.0.0.2/24", "fd00::2/64"), resultOf("fd00::2/64", "10.0.0.2/24"), []string{}},
+		{resultOf(), resultOf(), []string{}},
+		{
+			resultOf("10.0.0.2/24"),
+			resultOf("10.0.0.3/24"),
+			[]string{
+				"address 10.0.0.2/24 of ADD's result is missing from prevResult",
+				"address 10.0.0.3/24 of prevResult was not given by ADD",
+			},
+		},
+		{
+			resultOf("10.0.0.2/24"),
+			resultOf("10.0.0.2/16"),
+			[]string{
+				"address 10.0.0.2/16 of prevResult was not given by ADD",
+				"address 10.0.0.2/24 of ADD's result is missing from prevResult",
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := compareResults(test.cached, test.result); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("compareResults() = %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestDecodeCachedResult(t *testing.T) {
+	tests := []string{
+		`{"cniVersion":"0.4.0","ips":[{"version":"4","address":"10.0.0.2/24","gateway":"10.0.0.1"}]}`,
+		`{"ips":[{"version":"4","address":"10.0.0.2/24","gateway":"10.0.0.1"}]}`,
+		`{"cniVersion":"1.1.0","ips":[{"address":"10.0.0.2/24","gateway":"10.0.0.1"}]}`,
+	}
+	for _, raw := range tests {
+		result, err := decodeCachedResult([]byte(raw))
+		if err != nil {
+			t.Errorf("decodeCachedResult(%s) = %v", raw, err)
+			continue
+		}
+		if result.CNIVersion != current.ImplementedSpecVersion || len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.0.0.2/24" {
+			t.Errorf("decodeCachedResult(%s) = %+v", raw, result)
+		}
+		if _, err := result.GetAsVersion("0.4.0"); err != nil {
+			t.Errorf("decodeCachedResult(%s) cannot be printed as 0.4.0: %v", raw, err)
+		}
+	}
+}
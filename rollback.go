@@ -0,0 +1,59 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ipam"
+)
+
+// An ADD that fails once it started on the container's interface is rolled
+// back, rather than leaving a veth, a port with its flows, a NIC in the pod
+// or an address behind until the runtime's DEL, which may never come.
+// Rolling back is best effort: its failure is only mentioned on stderr, and
+// DEL or GC clean up what it left.
+
+// rollbackAdd undoes an ADD as GC collects a container, or as DEL gives a
+// host device back or deletes a macvlan or ipvlan link, and releases its
+// addresses if IPAM got as far as handing them out, in what is left of the
+// deadline. An ADD that failed before, e.g. a repeated one, must not release
+// the addresses of the attachment it repeats.
+func rollbackAdd(config *RainierConfig, args *skel.CmdArgs, ipamAdded bool) error {
+	extendDeadline()
+	switch config.Mode {
+	case ModeHostDevice:
+		if err := releaseHostDevice(config, args); err != nil {
+			return err
+		}
+	case ModeMacvlan, ModeIpvlan:
+		if err := deleteLink(config, args); err != nil {
+			return err
+		}
+	default:
+		if err := rollbackPort(config, args); err != nil {
+			return err
+		}
+	}
+	if err := forgetAttachment(attachmentKey(config.Name, args.ContainerID, args.IfName)); err != nil {
+		return err
+	}
+	if ipamAdded && config.IPAM.Type != "" {
+		return ipam.ExecDel(config.IPAM.Type, args.StdinData)
+	}
+	return nil
+}
+
+func rollbackPort(config *RainierConfig, args *skel.CmdArgs) error {
+	unlock, err := lockPorts(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	key := attachmentKey(config.Name, args.ContainerID, args.IfName)
+	readHostInterfacesFromFile()
+	if hostIfName, ok := hostInterfaces[key].(string); ok {
+		return collectContainer(config, key, hostIfName)
+	}
+	return nil
+}
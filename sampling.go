@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const DefaultCollectorSetID = 1
+
+// Sampling exports sampled packets of selected pods to an IPFIX collector.
+// Pods opt in with the "sample" pod argument, or opt out of a network that
+// samples by Default. Unlike bridge-wide sFlow, only the selected ports are
+// sampled, which keeps the collector's load down.
+type Sampling struct {
+	Collector      string `json:"collector"`
+	Probability    int    `json:"probability"`
+	CollectorSetID int    `json:"collectorSetID"`
+	Default        bool   `json:"default"`
+}
+
+func validateSampling(sampling *Sampling) error {
+	if sampling == nil {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(sampling.Collector); err != nil {
+		return fmt.Errorf("sampling has invalid collector %q", sampling.Collector)
+	}
+	if sampling.Probability < 1 || sampling.Probability > 65535 {
+		return fmt.Errorf("sampling probability must be within 1-65535")
+	}
+	if sampling.CollectorSetID == 0 {
+		sampling.CollectorSetID = DefaultCollectorSetID
+	}
+	return nil
+}
+
+func ensureSamplingCollector(bridgeName string, sampling *Sampling) error {
+	id := strconv.Itoa(sampling.CollectorSetID)
+	uuid, err := vsctl("--bare", "--columns=_uuid", "find", "flow_sample_collector_set", "id="+id)
+	if err != nil {
+		return err
+	}
+	if uuid == "" {
+		_, err = vsctl("--", "--id=@br", "get", "bridge", bridgeName,
+			"--", "--id=@ipfix", "create", "ipfix", fmt.Sprintf("targets=%q", sampling.Collector),
+			"--", "create", "flow_sample_collector_set", "id="+id, "bridge=@br", "ipfix=@ipfix")
+	} else {
+		// The replaced IPFIX record is garbage collected by ovsdb
+		_, err = vsctl("--", "--id=@ipfix", "create", "ipfix", fmt.Sprintf("targets=%q", sampling.Collector),
+			"--", "set", "flow_sample_collector_set", uuid, "ipfix=@ipfix")
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to set up IPFIX collector %s on bridge %s. Error = %s", sampling.Collector, bridgeName, err)
+	}
+	return nil
+}
+
+func samplePort(sampling *Sampling, pod podArgs, pipeline *portPipeline) error {
+	enabled, err := pod.bool("sample", sampling.Default)
+	if err != nil || !enabled {
+		return err
+	}
+	pipeline.add("", fmt.Sprintf("sample(probability=%d,collector_set_id=%d,obs_domain_id=0,obs_point_id=%d)",
+		sampling.Probability, sampling.CollectorSetID, pipeline.ofport))
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Seed flows are the bridge's baseline pipeline, such as table-miss
+// behaviour, drop rules or punts to a controller. ADD installs them when it
+// creates or adopts the bridge. Flows do not survive an ovs-vswitchd
+// restart, so the reseed subcommand reinstalls them from a hook run after
+// the restart.
+
+func validateSeedFlows(flows []string) error {
+	for _, flow := range flows {
+		if !strings.Contains(flow, "actions=") {
+			return fmt.Errorf("seed flow %q has no actions", flow)
+		}
+		if strings.Contains(flow, "cookie=") {
+			return fmt.Errorf("seed flow %q must not set a cookie, rainier sets its own", flow)
+		}
+		if err := validateFlowTemplate(flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureSeedFlows reinstalls the seed flows unless the bridge has exactly as
+// many as configured, which keeps ADD from churning them
+func ensureSeedFlows(bridgeName string, seeds []string) error {
+	cookie := flowCookie(featureSeed, 0)
+	match := fmt.Sprintf("cookie=%#x/%#x", cookie, cookieMagicMask|cookieFeatureMask)
+	out, err := ofctl("dump-flows", bridgeName, match)
+	if err != nil {
+		return fmt.Errorf("Failed to dump seed flows of bridge %s. Error = %s", bridgeName, err)
+	}
+	if strings.Count(out, "cookie=") == len(seeds) {
+		return nil
+	}
+
+	flows := []string{}
+	for _, seed := range seeds {
+		flows = append(flows, fmt.Sprintf("cookie=%#x,%s", cookie, seed))
+	}
+	return replaceFlows(bridgeName, match, flows...)
+}
+
+// cmdReseed reinstalls the seed flows of a network's bridge and, with
+// -ports, the flows of every container still attached to it, all in one
+// batch. Run from a boot or ovs-vswitchd restart hook before the node is
+// marked ready, it has the flows in place before pods send their first
+// packet rather than at their next CNI call:
+//
+//	rainier reseed [-conf rainier.conf] [-ports]
+func cmdReseed(args []string) error {
+	flags := flag.NewFlagSet("reseed", flag.ContinueOnError)
+	confPath := flags.String("conf", DefaultConfPath, "rainier network configuration")
+	ports := flags.Bool("ports", false, "also reinstall the flows of attached containers")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	jsonByte, err := ioutil.ReadFile(*confPath)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(jsonByte)
+	if err != nil {
+		return fmt.Errorf("invalid configuration %s: %v", *confPath, err)
+	}
+	if !*ports {
+		return ensureSeedFlows(config.PublicBridgeName, config.SeedFlows)
+	}
+
+	cookie := flowCookie(featureSeed, 0)
+	flows := []string{}
+	for _, seed := range config.SeedFlows {
+		flows = append(flows, fmt.Sprintf("cookie=%#x,%s", cookie, seed))
+	}
+	attached, err := attachedPortFlows(config)
+	if err != nil {
+		return err
+	}
+	flows = append(flows, attached...)
+	match := fmt.Sprintf("cookie=%#x/%#x", cookie, cookieMagicMask|cookieFeatureMask)
+	return batchFlows(config.PublicBridgeName, match, flows, ovsBundles())
+}
+
+// attachedPortFlows builds the flows of the network's containers whose
+// ports are on its bridge, with the pod arguments they were added with
+func attachedPortFlows(config *RainierConfig) ([]string, error) {
+	tunnels, err := peerTunnels(config.Peers, config.VNI)
+	if err != nil {
+		return nil, err
+	}
+	readHostInterfacesFromFile()
+	readPodArgsFromFile()
+	flows := []string{}
+	for key, name := range hostInterfaces {
+		hostIfName := name.(string)
+		if bridgeName, err := vsctl("port-to-br", hostIfName); err != nil || bridgeName != config.PublicBridgeName {
+			continue
+		}
+		ofport, err := getOfport(hostIfName)
+		if err != nil {
+			return nil, err
+		}
+		pod := attachedPodArgs[key]
+		if pod == nil {
+			pod = make(podArgs)
+		}
+		ports, err := portFlows(config, pod, ofport, tunnels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build flows of container %s: %v", keyContainerID(key), err)
+		}
+		flows = append(flows, ports...)
+	}
+	return flows, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const SegmentJson = StateDir + "/segments.json"
+const MaxVlanTag = 4094
+
+// Networks with a VNI are isolated from each other on the bridge by giving
+// each of them a local VLAN tag. The tag is only meaningful inside the bridge;
+// the VNI is what identifies the network on the tunnels. A tag is released
+// once no container port carries it any more, along with the segment's
+// tunnels, which the next ADD creates again.
+var segments = make(map[string]map[string]int)
+
+func allocateSegmentTag(bridgeName string, vni uint32) (int, error) {
+	key := strconv.FormatUint(uint64(vni), 10)
+	tag := 0
+	err := updateState(SegmentJson, &segments, func() error {
+		if segments[bridgeName] == nil {
+			segments[bridgeName] = make(map[string]int)
+		}
+		if allocated, ok := segments[bridgeName][key]; ok {
+			tag = allocated
+			return nil
+		}
+
+		used := make(map[int]bool)
+		for _, allocated := range segments[bridgeName] {
+			used[allocated] = true
+		}
+		for candidate := 1; candidate <= MaxVlanTag; candidate++ {
+			if !used[candidate] {
+				segments[bridgeName][key] = candidate
+				tag = candidate
+				return nil
+			}
+		}
+		return fmt.Errorf("No free segment tag left on bridge %s for vni %d", bridgeName, vni)
+	})
+	return tag, err
+}
+
+// releaseSegmentTag frees the VNI's tag and deletes the tunnels tagged with
+// it when no other port has it. PortsLock must be held exclusively, which
+// keeps ADD from tagging a port with it in between.
+func releaseSegmentTag(bridgeName string, vni uint32) error {
+	key := strconv.FormatUint(uint64(vni), 10)
+	if err := readState(SegmentJson, &segments); err != nil {
+		return err
+	}
+	tag, ok := segments[bridgeName][key]
+	if !ok {
+		return nil
+	}
+
+	out, err := vsctl("--bare", "--columns=name", "find", "port", "tag="+strconv.Itoa(tag))
+	if err != nil {
+		return fmt.Errorf("Failed to list the ports of segment %d. Error = %s", tag, err)
+	}
+	ids, err := externalIDs("port")
+	if err != nil {
+		return err
+	}
+	tunnels := []string{}
+	for _, portName := range strings.Fields(out) {
+		if ids[portName]["rainier-peer"] == "" && ids[portName]["rainier-overlay"] == "" {
+			return nil
+		}
+		tunnels = append(tunnels, portName)
+	}
+	for _, portName := range tunnels {
+		if _, err := vsctl("--if-exists", "del-port", bridgeName, portName); err != nil {
+			return fmt.Errorf("Failed to delete tunnel port %s. Error = %s", portName, err)
+		}
+	}
+	return updateState(SegmentJson, &segments, func() error {
+		if segments[bridgeName][key] == tag {
+			delete(segments[bridgeName], key)
+		}
+		return nil
+	})
+}
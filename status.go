@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// ErrPluginNotAvailable is the CNI error code STATUS fails with when ADD
+// cannot succeed on the node
+const ErrPluginNotAvailable uint = 50
+
+// STATUS, from CNI 1.1, lets the runtime mark the node's network NotReady
+// while OVS is down, instead of pod sandboxes failing one by one. Runtimes
+// only send it for configurations of cniVersion 1.1.0 or later. ADD
+// creates a missing bridge, so a bridge that does not exist yet only needs
+// a reachable ovsdb; requiring it would keep the node NotReady and never
+// schedule the first pod that creates it.
+
+// cmdStatus fails with ErrPluginNotAvailable unless the failure has a code
+// of its own, rather than with skel's internal error
+func cmdStatus(args *skel.CmdArgs) error {
+	err := nodeStatus(args.StdinData)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*types.Error); ok {
+		return e
+	}
+	return &types.Error{Code: ErrPluginNotAvailable, Msg: "rainier is not available", Details: err.Error()}
+}
+
+func nodeStatus(stdinData []byte) error {
+	config, err := loadConfig(stdinData)
+	if err != nil {
+		return err
+	}
+	if err := maintenanceMode(); err != nil {
+		return notAvailable(err)
+	}
+	if err := breakerOpen(); err != nil {
+		return notAvailable(err)
+	}
+
+	// ovsdb-server answers vsctl, ovs-vswitchd answers appctl
+	if _, err := vsctl("list-br"); err != nil {
+		return notAvailable(fmt.Errorf("ovsdb-server is not reachable: %v", err))
+	}
+	if _, err := ovsExec("ovs-appctl", "-t", "ovs-vswitchd", "version"); err != nil {
+		return notAvailable(fmt.Errorf("ovs-vswitchd is not reachable: %v", err))
+	}
+	if _, err := vsctl("br-exists", config.PublicBridgeName); err == nil {
+		if _, err := ofctl("show", config.PublicBridgeName); err != nil {
+			return notAvailable(fmt.Errorf("bridge %s does not answer OpenFlow: %v", config.PublicBridgeName, err))
+		}
+	}
+
+	// IPAM is usable when its plugin can be found, or not needed
+	if config.IPAM.Type != "" {
+		if err := validateIpamType(config.IPAM.Type, config.AllowedIpamTypes); err != nil {
+			return notAvailable(err)
+		}
+		paths := filepath.SplitList(os.Getenv("CNI_PATH"))
+		if _, err := invoke.FindInPath(config.IPAM.Type, paths); err != nil {
+			return notAvailable(fmt.Errorf("IPAM plugin %s not found: %v", config.IPAM.Type, err))
+		}
+	}
+	return nil
+}
+
+func notAvailable(err error) error {
+	details := err.Error()
+	if e, ok := err.(*types.Error); ok {
+		details = e.Msg
+		if e.Details != "" {
+			details += ": " + e.Details
+		}
+	}
+	return &types.Error{Code: ErrPluginNotAvailable, Msg: "rainier is not available", Details: details}
+}
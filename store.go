@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+const StateDir = "/var/lib/rainier"
+const StateLock = StateDir + "/state.lock"
+
+// rainier's state used to live in /tmp, which reboots wipe while OVS keeps
+// the ports. State left there by an older binary is read until the first
+// update moves it to StateDir.
+var legacyStateFiles = map[string]string{
+	HostInterfaceJson: "/tmp/rainier.json",
+	SegmentJson:       "/tmp/rainier-segments.json",
+	AddressJson:       "/tmp/rainier-addresses.json",
+	ModeJson:          "/tmp/rainier-modes.json",
+	PodArgsJson:       "/tmp/rainier-pod-args.json",
+	BreakerJson:       "/tmp/rainier-ovs-breaker.json",
+}
+
+// networkNamePattern is what the CNI specification allows in network names
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+
+func validateNetworkName(name string) error {
+	if !networkNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid network name %q, must be letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// State is kept per attachment, a container's interface on a network, as a
+// container may be attached to several networks or to one several times.
+// attachmentKey joins network, container ID and interface name with '/',
+// which none of them may contain: CNI limits network names and container
+// IDs to letters, digits, '_', '.' and '-'.
+func attachmentKey(network string, containerID string, ifName string) string {
+	return network + "/" + containerID + "/" + ifName
+}
+
+// splitAttachmentKey returns the network, container ID and interface name
+// of an attachment key
+func splitAttachmentKey(key string) (string, string, string) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return "", key, ""
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+func keyContainerID(key string) string {
+	_, containerID, _ := splitAttachmentKey(key)
+	return containerID
+}
+
+// Versions before per-attachment state keyed it by container ID alone, and
+// so tracked one attachment per container. migrateLegacyState moves the
+// state such a version left for a container to the first of its
+// attachments that is deleted, checked or collected and has no state of its
+// own, unless the legacy port records another network. Flow cookies are
+// derived from OpenFlow ports and iptables chain names are hashed by
+// utils.FormatChainName, so neither depends on the key.
+func migrateLegacyState(network string, containerID string, ifName string) error {
+	readHostInterfacesFromFile()
+	name, ok := hostInterfaces[containerID].(string)
+	if !ok {
+		return nil
+	}
+	if owner := interfaceExternalID(name, "rainier-network"); owner != "" && owner != network {
+		return nil
+	}
+	key := attachmentKey(network, containerID, ifName)
+	files := []stateFile{
+		{HostInterfaceJson, &hostInterfaces},
+		{AddressJson, &addresses},
+		{ModeJson, &modes},
+		{PodArgsJson, &attachedPodArgs},
+	}
+	return updateStates(files, func() error {
+		if _, ok := hostInterfaces[key]; ok {
+			return nil
+		}
+		legacy := reflect.ValueOf(containerID)
+		for _, f := range files {
+			state := reflect.ValueOf(f.v).Elem()
+			if value := state.MapIndex(legacy); value.IsValid() {
+				state.SetMapIndex(reflect.ValueOf(key), value)
+				state.SetMapIndex(legacy, reflect.Value{})
+			}
+		}
+		return nil
+	})
+}
+
+// Pods are created in parallel, each ADD and DEL in a process of its own, so
+// state files are changed under StateLock and replaced by renaming a new
+// file over them. Readers never see a half-written file and need no lock.
+
+// readState decodes the state file at path into v, which is left empty when
+// there is no such file
+func readState(path string, v interface{}) error {
+	// Start over, as decoding into a map keeps the keys it already had
+	value := reflect.ValueOf(v).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	if value.Kind() == reflect.Map {
+		value.Set(reflect.MakeMap(value.Type()))
+	}
+
+	jsonByte, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && legacyStateFiles[path] != "" {
+		jsonByte, err = ioutil.ReadFile(legacyStateFiles[path])
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Fail to read state %s. Error = %s", path, err)
+	}
+	if err := json.Unmarshal(jsonByte, v); err != nil {
+		return fmt.Errorf("Fail to decode state %s. Error = %s", path, err)
+	}
+	return nil
+}
+
+// stateFile is a state file and the variable it is read into
+type stateFile struct {
+	path string
+	v    interface{}
+}
+
+// updateState reads the state file at path into v, lets update change it and
+// writes it back, all under StateLock. Nothing is written when update fails.
+// update must not update state itself.
+func updateState(path string, v interface{}, update func() error) error {
+	return updateStates([]stateFile{{path, v}}, update)
+}
+
+// updateStates is updateState for changes that span state files
+func updateStates(files []stateFile, update func() error) error {
+	if err := os.MkdirAll(StateDir, 0755); err != nil {
+		return fmt.Errorf("Fail to create %s. Error = %s", StateDir, err)
+	}
+	lock, err := lockFile(StateLock, syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("Failed to lock %s. Error = %s", StateLock, err)
+	}
+	defer lock.Close()
+
+	for _, f := range files {
+		if err := readState(f.path, f.v); err != nil {
+			return err
+		}
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := writeState(f.path, f.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeState replaces the state file at path, syncing it and its directory
+// so that it survives a crash or a reboot
+func writeState(path string, v interface{}) error {
+	jsonByte, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Fail to encode state %s. Error = %s", path, err)
+	}
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Fail to write state %s. Error = %s", path, err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(jsonByte)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("Fail to write state %s. Error = %s", path, err)
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestAttachmentKey(t *testing.T) {
+	tests := []struct {
+		key         string
+		network     string
+		containerID string
+		ifName      string
+	}{
+		{attachmentKey("rainier-net", "f00ba4", "eth0"), "rainier-net", "f00ba4", "eth0"},
+		{attachmentKey("net.v2", "f00-ba4", "net1"), "net.v2", "f00-ba4", "net1"},
+		// State of older versions is keyed by container ID alone
+		{"f00ba4", "", "f00ba4", ""},
+	}
+	for _, test := range tests {
+		network, containerID, ifName := splitAttachmentKey(test.key)
+		if network != test.network || containerID != test.containerID || ifName != test.ifName {
+			t.Errorf("splitAttachmentKey(%q) = %q, %q, %q, want %q, %q, %q",
+				test.key, network, containerID, ifName, test.network, test.containerID, test.ifName)
+		}
+		if got := keyContainerID(test.key); got != test.containerID {
+			t.Errorf("keyContainerID(%q) = %q, want %q", test.key, got, test.containerID)
+		}
+	}
+}
+
+func TestValidateNetworkName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"rainier", true},
+		{"rainier-net_1.v2", true},
+		{"", false},
+		{"-rainier", false},
+		{"tenant/net", false},
+		{"rainier net", false},
+	}
+	for _, test := range tests {
+		if err := validateNetworkName(test.name); (err == nil) != test.valid {
+			t.Errorf("validateNetworkName(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var traceCookiePattern = regexp.MustCompile(`cookie[ =](0x[0-9a-f]+)`)
+
+// cmdTrace runs ofproto/trace for a packet the container would send and
+// tells for every matched flow which rainier feature installed it:
+//
+//	rainier trace [-proto tcp|udp|icmp] [-port n] [-src-mac mac] [-dst-mac mac] <containerID> <dst>
+func cmdTrace(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ContinueOnError)
+	proto := flags.String("proto", "tcp", "tcp, udp or icmp")
+	port := flags.Int("port", 80, "destination port for tcp and udp")
+	srcMAC := flags.String("src-mac", "", "source MAC, the one learned on the container's port by default")
+	dstMAC := flags.String("dst-mac", "ff:ff:ff:ff:ff:ff", "destination MAC, e.g. the gateway's")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: rainier trace [flags] <containerID> <dst>")
+	}
+	containerID := flags.Arg(0)
+	dst := net.ParseIP(flags.Arg(1))
+	if dst == nil {
+		return fmt.Errorf("invalid destination %q", flags.Arg(1))
+	}
+
+	key, err := containerAttachment(containerID)
+	if err != nil {
+		return err
+	}
+	bridgeName, _, ofport, err := containerPort(key)
+	if err != nil {
+		return err
+	}
+
+	// Source the packet from the container's address of the same family
+	readAddressesFromFile()
+	var src net.IP
+	for _, address := range addresses[key] {
+		if ip := net.ParseIP(address); ip != nil && (ip.To4() == nil) == (dst.To4() == nil) {
+			src = ip
+		}
+	}
+	if src == nil {
+		return fmt.Errorf("container %s has no address of the family of %s", containerID, dst)
+	}
+	if *srcMAC == "" {
+		*srcMAC = learnedMAC(bridgeName, ofport)
+	}
+
+	packet, err := traceFlow(ofport, *srcMAC, *dstMAC, src, dst, *proto, *port)
+	if err != nil {
+		return err
+	}
+	out, err := ovsExec("ovs-appctl", "ofproto/trace", bridgeName, packet)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if m := traceCookiePattern.FindStringSubmatch(line); m != nil {
+			if cookie, err := strconv.ParseUint(strings.TrimPrefix(m[1], "0x"), 16, 64); err == nil {
+				line = fmt.Sprintf("%s  [%s]", line, describeCookie(cookie))
+			}
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func traceFlow(ofport int, srcMAC string, dstMAC string, src net.IP, dst net.IP, proto string, port int) (string, error) {
+	v6 := dst.To4() == nil
+	match := ""
+	switch proto {
+	case "tcp", "udp":
+		match = fmt.Sprintf("%s,tp_dst=%d", proto, port)
+		if v6 {
+			match = fmt.Sprintf("%s6,tp_dst=%d", proto, port)
+		}
+	case "icmp":
+		match = "icmp,icmp_type=8"
+		if v6 {
+			match = "icmp6,icmp_type=128"
+		}
+	default:
+		return "", fmt.Errorf("invalid protocol %q", proto)
+	}
+	addrs := fmt.Sprintf("nw_src=%s,nw_dst=%s", src, dst)
+	if v6 {
+		addrs = fmt.Sprintf("ipv6_src=%s,ipv6_dst=%s", src, dst)
+	}
+	return fmt.Sprintf("in_port=%d,dl_src=%s,dl_dst=%s,%s,%s", ofport, srcMAC, dstMAC, match, addrs), nil
+}
+
+// learnedMAC returns the first MAC the bridge learned on the port
+func learnedMAC(bridgeName string, ofport int) string {
+	out, err := ovsExec("ovs-appctl", "fdb/show", bridgeName)
+	if err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && fields[0] == strconv.Itoa(ofport) {
+				return fields[2]
+			}
+		}
+	}
+	return "00:00:00:00:00:00"
+}
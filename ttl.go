@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+)
+
+// MaxMinTTL bounds Ttl.Min; OpenFlow cannot match a TTL range, so every
+// value below the minimum costs a drop flow per address family
+const MaxMinTTL = 64
+
+// Ttl guards the network against routing loops in containers that route.
+// Decrement makes the bridge act as a hop, so looping packets die, and Min
+// drops packets sent with a lower TTL or hop limit.
+type Ttl struct {
+	Decrement bool `json:"decrement"`
+	Min       int  `json:"min"`
+}
+
+func validateTtl(ttl *Ttl) error {
+	if ttl == nil {
+		return nil
+	}
+	if ttl.Min < 0 || ttl.Min > MaxMinTTL {
+		return fmt.Errorf("ttl min must be within 0-%d", MaxMinTTL)
+	}
+	return nil
+}
+
+func ttlPort(ttl *Ttl, pipeline *portPipeline) {
+	for _, class := range []string{"ip", "ipv6"} {
+		if ttl.Decrement {
+			pipeline.add(class, "dec_ttl")
+		}
+		for value := 0; value < ttl.Min; value++ {
+			pipeline.drop(featureTtl, fmt.Sprintf("%s,nw_ttl=%d", class, value))
+		}
+	}
+}
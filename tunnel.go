@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const TunnelTypeGre = "gre"
+
+// Tunnel is a point-to-point tunnel port on the bridge, e.g. to a router or
+// another site that speaks GRE or Geneve. ADD creates the network's tunnels and
+// removes the ones it created earlier that are no longer configured.
+type Tunnel struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	RemoteIP string `json:"remoteIP"`
+	Key      uint32 `json:"key"`
+	Csum     bool   `json:"csum"`
+}
+
+func validateTunnels(tunnels []Tunnel) error {
+	names := make(map[string]bool)
+	for i := range tunnels {
+		t := &tunnels[i]
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("tunnels need unique names, got %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.Type == "" {
+			t.Type = TunnelTypeGre
+		}
+		if t.Type != TunnelTypeGre && t.Type != TunnelTypeGeneve {
+			return fmt.Errorf("tunnel %q has unsupported type %q", t.Name, t.Type)
+		}
+		if net.ParseIP(t.RemoteIP) == nil {
+			return fmt.Errorf("tunnel %q has invalid remoteIP %q", t.Name, t.RemoteIP)
+		}
+	}
+	return nil
+}
+
+func tunnelPortName(network string, t Tunnel) string {
+	return fmt.Sprintf("rvg%08x", crc32.ChecksumIEEE([]byte(network+"/"+t.Name)))
+}
+
+// ensureTunnels converges the tunnel ports of a network to its
+// configuration. Ports are marked with the network's name, so that networks
+// sharing the bridge leave each other's tunnels alone.
+func ensureTunnels(bridgeName string, network string, tunnels []Tunnel) error {
+	wanted := make(map[string]bool)
+	for _, t := range tunnels {
+		portName := tunnelPortName(network, t)
+		wanted[portName] = true
+		args := []string{"--may-exist", "add-port", bridgeName, portName,
+			"--", "set", "interface", portName, "type=" + t.Type,
+			"options:remote_ip=" + t.RemoteIP,
+			"options:csum=" + strconv.FormatBool(t.Csum)}
+		if t.Key != 0 {
+			args = append(args, "options:key="+strconv.FormatUint(uint64(t.Key), 10))
+		} else {
+			args = append(args, "--", "remove", "interface", portName, "options", "key")
+		}
+		args = append(args, "--", "set", "port", portName,
+			fmt.Sprintf("external_ids:rainier-tunnel=%q", network),
+			fmt.Sprintf("external_ids:rainier-tunnel-name=%q", t.Name))
+		if _, err := vsctl(args...); err != nil {
+			return fmt.Errorf("Failed to add %s tunnel port %s for tunnel %s. Error = %s", t.Type, portName, t.Name, err)
+		}
+	}
+
+	// Remove the tunnels that are no longer configured
+	out, err := vsctl("--bare", "--columns=name", "find", "port", fmt.Sprintf("external_ids:rainier-tunnel=%q", network))
+	if err != nil {
+		return err
+	}
+	for _, portName := range strings.Fields(out) {
+		if wanted[portName] {
+			continue
+		}
+		if _, err := vsctl("--if-exists", "del-port", bridgeName, portName); err != nil {
+			return fmt.Errorf("Failed to delete tunnel port %s. Error = %s", portName, err)
+		}
+	}
+	return nil
+}
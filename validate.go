@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+)
+
+// cmdValidate compares a network configuration with the one it is about to
+// replace, listing every setting that changes and failing when a change
+// would disrupt containers that are already attached:
+//
+//	rainier validate -old a.conf -new b.conf
+func cmdValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	oldPath := flags.String("old", DefaultConfPath, "configuration in use")
+	newPath := flags.String("new", "", "configuration to roll out")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *newPath == "" {
+		return fmt.Errorf("usage: rainier validate [-old a.conf] -new b.conf")
+	}
+
+	oldConfig, err := loadConfigFile(*oldPath)
+	if err != nil {
+		return err
+	}
+	newConfig, err := loadConfigFile(*newPath)
+	if err != nil {
+		return err
+	}
+
+	changes, err := configChanges(oldConfig, newConfig)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	disruptions := configDisruptions(oldConfig, newConfig)
+	for _, disruption := range disruptions {
+		fmt.Println("disruptive: " + disruption)
+	}
+	if len(disruptions) > 0 {
+		return fmt.Errorf("%d of %d changes would disrupt attached containers", len(disruptions), len(changes))
+	}
+	return nil
+}
+
+func loadConfigFile(path string) (*RainierConfig, error) {
+	jsonByte, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(jsonByte)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// configChanges lists the settings that differ once both configurations
+// are parsed and defaulted, so formatting and spelled out defaults do not
+// count as changes
+func configChanges(oldConfig *RainierConfig, newConfig *RainierConfig) ([]string, error) {
+	oldSettings, err := configSettings(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newSettings, err := configSettings(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range oldSettings {
+		keys = append(keys, key)
+	}
+	for key := range newSettings {
+		if _, ok := oldSettings[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []string{}
+	for _, key := range keys {
+		if reflect.DeepEqual(oldSettings[key], newSettings[key]) {
+			continue
+		}
+		oldValue, _ := json.Marshal(oldSettings[key])
+		newValue, _ := json.Marshal(newSettings[key])
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, oldValue, newValue))
+	}
+	return changes, nil
+}
+
+func configSettings(config *RainierConfig) (map[string]interface{}, error) {
+	jsonByte, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]interface{})
+	if err := json.Unmarshal(jsonByte, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// configDisruptions lists the changes that attached containers would not
+// survive, because DEL and CHECK would look for them in the wrong place
+func configDisruptions(oldConfig *RainierConfig, newConfig *RainierConfig) []string {
+	disruptions := []string{}
+	if oldConfig.Name != newConfig.Name {
+		disruptions = append(disruptions, "renaming the network leaks the addresses IPAM handed out under the old name")
+	}
+	if oldConfig.IPAM.Type != newConfig.IPAM.Type {
+		disruptions = append(disruptions, "attached containers would have their addresses released by the wrong IPAM plugin")
+	}
+	if oldConfig.PublicBridgeName != newConfig.PublicBridgeName {
+		disruptions = append(disruptions, fmt.Sprintf("attached containers stay on bridge %s, away from new ones on %s",
+			oldConfig.PublicBridgeName, newConfig.PublicBridgeName))
+	}
+	if oldConfig.Uplink != newConfig.Uplink {
+		disruptions = append(disruptions, "changing the uplink leaves the old one on the bridge")
+	}
+	if oldConfig.VNI != newConfig.VNI {
+		disruptions = append(disruptions, "attached containers stay in the old VNI's segment, cut off from new ones")
+	}
+	if newConfig.MTU < oldConfig.MTU {
+		disruptions = append(disruptions, fmt.Sprintf("attached containers keep MTU %d and send packets new ones drop (MTU %d)",
+			oldConfig.MTU, newConfig.MTU))
+	}
+	if !reflect.DeepEqual(oldConfig.SubnetVlans, newConfig.SubnetVlans) {
+		disruptions = append(disruptions, "attached containers keep the VLAN of the old subnetVlans")
+	}
+	return disruptions
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// Version, Commit and BuildDate describe the build, set at build time with
+// -ldflags "-X main.Version=v1.2.3 -X main.Commit=... -X main.BuildDate=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// What this binary can attach containers with. The datapaths it can program
+// are the registered backends.
+var (
+	supportedPortTypes   = []string{"veth", "host-device", "macvlan", "ipvlan"}
+	supportedTunnelTypes = []string{"vxlan", TunnelTypeGre, TunnelTypeGeneve}
+)
+
+var supportedModes = []string{ModeBridge, ModePtp, ModeHostDevice, ModeMacvlan, ModeIpvlan}
+
+// Capabilities rainier takes from runtimeConfig
+var supportedCapabilities = []string{"mac", "vlan", "portMappings", "bandwidth", "ips"}
+
+// versionInfo adds what rainier supports to the VERSION output, so that
+// orchestration layers can feature-detect it. Runtimes only read the CNI
+// versions and ignore the rest.
+type versionInfo struct {
+	version.PluginInfo
+}
+
+type rainierVersion struct {
+	Version      string   `json:"version"`
+	Modes        []string `json:"modes"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (v versionInfo) Encode(w io.Writer) error {
+	supported := v.SupportedVersions()
+	return json.NewEncoder(w).Encode(struct {
+		CNIVersion        string         `json:"cniVersion"`
+		SupportedVersions []string       `json:"supportedVersions"`
+		Rainier           rainierVersion `json:"rainier"`
+	}{
+		CNIVersion:        supported[len(supported)-1],
+		SupportedVersions: supported,
+		Rainier: rainierVersion{
+			Version:      Version,
+			Modes:        supportedModes,
+			Capabilities: supportedCapabilities,
+		},
+	})
+}
+
+func about() string {
+	return fmt.Sprintf("Rainier CNI %s, modes: %s, capabilities: %s",
+		Version, strings.Join(supportedModes, ", "), strings.Join(supportedCapabilities, ", "))
+}
+
+type buildInfo struct {
+	Version           string   `json:"version"`
+	Commit            string   `json:"commit"`
+	BuildDate         string   `json:"buildDate"`
+	GoVersion         string   `json:"goVersion"`
+	CNIVersions       []string `json:"cniVersions"`
+	Modes             []string `json:"modes"`
+	Capabilities      []string `json:"capabilities"`
+	PortTypes         []string `json:"portTypes"`
+	TunnelTypes       []string `json:"tunnelTypes"`
+	Backends          []string `json:"backends"`
+	OpenFlowProtocols []string `json:"openflowProtocols"`
+}
+
+// cmdVersion shows what the binary was built from and supports:
+//
+//	rainier version [-json]
+func cmdVersion(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	info := buildInfo{
+		Version:           Version,
+		Commit:            Commit,
+		BuildDate:         BuildDate,
+		GoVersion:         runtime.Version(),
+		CNIVersions:       version.All.SupportedVersions(),
+		Modes:             supportedModes,
+		Capabilities:      supportedCapabilities,
+		PortTypes:         supportedPortTypes,
+		TunnelTypes:       supportedTunnelTypes,
+		Backends:          backendNames(),
+		OpenFlowProtocols: supportedProtocols,
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+	fmt.Printf("rainier %s (commit %s, built %s with %s)\n", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+	fmt.Printf("CNI versions: %s\n", strings.Join(info.CNIVersions, ", "))
+	fmt.Printf("modes: %s\n", strings.Join(info.Modes, ", "))
+	fmt.Printf("capabilities: %s\n", strings.Join(info.Capabilities, ", "))
+	fmt.Printf("port types: %s\n", strings.Join(info.PortTypes, ", "))
+	fmt.Printf("tunnel types: %s\n", strings.Join(info.TunnelTypes, ", "))
+	fmt.Printf("backends: %s\n", strings.Join(info.Backends, ", "))
+	fmt.Printf("OpenFlow: %s\n", strings.Join(info.OpenFlowProtocols, ", "))
+	return nil
+}
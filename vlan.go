@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+)
+
+const MaxIfNameLen = 15
+const VlanPortJson = StateDir + "/vlan-ports.json"
+
+// The VLAN subinterfaces that carry pod, trunk and translated VLANs over an
+// uplink are bridge ports shared by the attachments that need them. Each
+// attachment records the ones it added; the last one to go deletes them,
+// port and link.
+type vlanPorts struct {
+	Bridge string   `json:"bridge"`
+	Ports  []string `json:"ports"`
+}
+
+var attachmentVlanPorts = make(map[string]vlanPorts)
+
+// SubnetVlan puts containers that get an address in Subnet on VLAN Vlan,
+// so that the IPAM allocation decides which L2 segment a port joins
+type SubnetVlan struct {
+	Subnet string `json:"subnet"`
+	Vlan   int    `json:"vlan"`
+}
+
+func validateVlan(vlan int) error {
+	if vlan < 1 || vlan > MaxVlanTag {
+		return fmt.Errorf("invalid vlan %d", vlan)
+	}
+	return nil
+}
+
+func validateSubnetVlans(mappings []SubnetVlan) error {
+	for _, mapping := range mappings {
+		if _, _, err := net.ParseCIDR(mapping.Subnet); err != nil {
+			return fmt.Errorf("subnetVlans has invalid subnet %q", mapping.Subnet)
+		}
+		if err := validateVlan(mapping.Vlan); err != nil {
+			return fmt.Errorf("subnetVlans entry %s: %v", mapping.Subnet, err)
+		}
+	}
+	return nil
+}
+
+func subnetVlanTag(mappings []SubnetVlan, result *current.Result) (int, error) {
+	for _, ipc := range result.IPs {
+		for _, mapping := range mappings {
+			_, subnet, _ := net.ParseCIDR(mapping.Subnet)
+			if subnet.Contains(ipc.Address.IP) {
+				return mapping.Vlan, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no subnetVlans entry covers the addresses assigned to the container")
+}
+
+// VlanTranslation maps the VLAN containers use on the bridge to the VLAN of
+// the provider network. A VLAN subinterface of Uplink for UplinkVlan is
+// attached to the bridge as an access port of Vlan, so the kernel does the
+// retagging in both directions. Uplink must therefore not be a bridge port.
+type VlanTranslation struct {
+	Vlan       int    `json:"vlan"`
+	UplinkVlan int    `json:"uplinkVlan"`
+	Uplink     string `json:"uplink"`
+}
+
+func validateVlanTranslations(translations []VlanTranslation, bridgeUplink string) error {
+	vlans := make(map[int]bool)
+	for _, t := range translations {
+		if err := validateVlan(t.Vlan); err != nil {
+			return fmt.Errorf("vlanTranslations: %v", err)
+		}
+		if err := validateVlan(t.UplinkVlan); err != nil {
+			return fmt.Errorf("vlanTranslations: invalid uplinkVlan %d", t.UplinkVlan)
+		}
+		if vlans[t.Vlan] {
+			return fmt.Errorf("vlanTranslations: vlan %d is translated twice", t.Vlan)
+		}
+		vlans[t.Vlan] = true
+		if t.Uplink == "" || t.Uplink == bridgeUplink {
+			return fmt.Errorf("vlanTranslations: uplink must be set and must not be the bridge's uplink")
+		}
+	}
+	return nil
+}
+
+func vlanSubinterfaceName(uplink string, vlan int) string {
+	name := fmt.Sprintf("%s.%d", uplink, vlan)
+	if len(name) > MaxIfNameLen {
+		name = fmt.Sprintf("rvl%08x", crc32.ChecksumIEEE([]byte(name)))
+	}
+	return name
+}
+
+func ensureVlanSubinterface(uplink string, vlan int) (string, error) {
+	name := vlanSubinterfaceName(uplink, vlan)
+	if link, err := netlink.LinkByName(name); err == nil {
+		if v, ok := link.(*netlink.Vlan); !ok || v.VlanId != vlan {
+			return "", fmt.Errorf("interface %s exists but is not VLAN %d of %s", name, vlan, uplink)
+		}
+		return name, netlink.LinkSetUp(link)
+	}
+
+	parent, err := netlink.LinkByName(uplink)
+	if err != nil {
+		return "", fmt.Errorf("failed to find uplink %s: %v", uplink, err)
+	}
+	link := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index},
+		VlanId:    vlan,
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return "", fmt.Errorf("failed to create VLAN %d on %s: %v", vlan, uplink, err)
+	}
+	return name, netlink.LinkSetUp(link)
+}
+
+func ensureVlanTranslation(bridgeName string, key string, translations []VlanTranslation, vlan int) error {
+	for _, t := range translations {
+		if t.Vlan != vlan {
+			continue
+		}
+		if err := addVlanSubinterfacePort(bridgeName, key, t.Uplink, t.UplinkVlan, t.Vlan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addVlanSubinterfacePort bridges VLAN uplinkVlan of uplink into the bridge's
+// VLAN tag, tagging on the wire by the kernel rather than by OVS. The port is
+// recorded as the attachment's first, so that a failed ADD releases it too.
+func addVlanSubinterfacePort(bridgeName string, key string, uplink string, uplinkVlan int, tag int) error {
+	if err := recordVlanPort(key, bridgeName, vlanSubinterfaceName(uplink, uplinkVlan)); err != nil {
+		return err
+	}
+	name, err := ensureVlanSubinterface(uplink, uplinkVlan)
+	if err != nil {
+		return err
+	}
+	_, err = vsctl("--may-exist", "add-port", bridgeName, name,
+		"--", "set", "port", name, "tag="+strconv.Itoa(tag))
+	if err != nil {
+		return fmt.Errorf("Failed to add VLAN port %s to bridge %s. Error = %s", name, bridgeName, err)
+	}
+	return nil
+}
+
+func recordVlanPort(key string, bridgeName string, name string) error {
+	return updateState(VlanPortJson, &attachmentVlanPorts, func() error {
+		record := attachmentVlanPorts[key]
+		for _, recorded := range record.Ports {
+			if recorded == name {
+				return nil
+			}
+		}
+		record.Bridge = bridgeName
+		record.Ports = append(record.Ports, name)
+		attachmentVlanPorts[key] = record
+		return nil
+	})
+}
+
+// releaseVlanPorts deletes the VLAN subinterface ports of an attachment that
+// no other attachment uses, and forgets the attachment's record. PortsLock
+// must be held exclusively, which keeps ADD from recording them in between.
+func releaseVlanPorts(key string) error {
+	if err := readState(VlanPortJson, &attachmentVlanPorts); err != nil {
+		return err
+	}
+	record, ok := attachmentVlanPorts[key]
+	if !ok {
+		return nil
+	}
+	used := make(map[string]bool)
+	for other, ports := range attachmentVlanPorts {
+		for _, name := range ports.Ports {
+			used[name] = used[name] || other != key
+		}
+	}
+	for _, name := range record.Ports {
+		if used[name] {
+			continue
+		}
+		if _, err := vsctl("--if-exists", "del-port", record.Bridge, name); err != nil {
+			return fmt.Errorf("Failed to delete VLAN port %s from bridge %s. Error = %s", name, record.Bridge, err)
+		}
+		if link, err := netlink.LinkByName(name); err == nil && link.Type() == "vlan" {
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", name, err)
+			}
+		}
+	}
+	return updateState(VlanPortJson, &attachmentVlanPorts, func() error {
+		delete(attachmentVlanPorts, key)
+		return nil
+	})
+}
+
+// releaseOrphanVlanPorts releases the VLAN ports of attachments that have no
+// host veth any more, e.g. because their ADD crashed. PortsLock must be held
+// exclusively.
+func releaseOrphanVlanPorts() error {
+	if err := readState(VlanPortJson, &attachmentVlanPorts); err != nil {
+		return err
+	}
+	readHostInterfacesFromFile()
+	for key := range attachmentVlanPorts {
+		if _, ok := hostInterfaces[key]; ok {
+			continue
+		}
+		if err := releaseVlanPorts(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// podVlan returns the VLAN a pod asked for, 0 if none: through the "vlan"
+// runtime config, or else its "vlan" argument. Pods may only pick VLANs
+// within allowedPodVlans when the network has any.
+func podVlan(config *RainierConfig, pod podArgs) (int, error) {
+	vlan := config.RuntimeConfig.Vlan
+	if value, ok := pod["vlan"]; ok && vlan == 0 {
+		var err error
+		if vlan, err = strconv.Atoi(value); err != nil {
+			return 0, fmt.Errorf("invalid value %q for pod argument vlan", value)
+		}
+	}
+	if vlan == 0 {
+		return 0, nil
+	}
+	if err := validateVlan(vlan); err != nil {
+		return 0, err
+	}
+	if len(config.AllowedPodVlans) > 0 && !vlanAllowed(config.AllowedPodVlans, vlan) {
+		return 0, fmt.Errorf("vlan %d is not within allowedPodVlans %s", vlan, strings.Join(config.AllowedPodVlans, ","))
+	}
+	return vlan, nil
+}
+
+// vlanRange parses a VLAN or a range of VLANs like "100-199"
+func vlanRange(value string) (int, int, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid vlan range %q", value)
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid vlan range %q", value)
+		}
+	}
+	if validateVlan(first) != nil || validateVlan(last) != nil || first > last {
+		return 0, 0, fmt.Errorf("invalid vlan range %q", value)
+	}
+	return first, last, nil
+}
+
+func validateAllowedPodVlans(ranges []string) error {
+	for _, value := range ranges {
+		if _, _, err := vlanRange(value); err != nil {
+			return fmt.Errorf("allowedPodVlans: %v", err)
+		}
+	}
+	return nil
+}
+
+func vlanAllowed(ranges []string, vlan int) bool {
+	for _, value := range ranges {
+		if first, last, err := vlanRange(value); err == nil && vlan >= first && vlan <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNetworkVlan checks the network's own VLAN, which its ports are
+// access ports of unless a pod asks for another one. Networks sharing a
+// bridge are isolated from each other by giving each a different VLAN.
+func validateNetworkVlan(config *RainierConfig) error {
+	if config.Vlan == 0 {
+		return nil
+	}
+	if err := validateVlan(config.Vlan); err != nil {
+		return err
+	}
+	if config.VNI != 0 || len(config.SubnetVlans) > 0 {
+		return fmt.Errorf("vlan cannot be used with vni or subnetVlans")
+	}
+	return nil
+}
+
+// portVlan returns the VLAN of a container's port: the pod's, else the
+// network's, 0 if neither
+func portVlan(config *RainierConfig, pod podArgs) (int, error) {
+	vlan, err := podVlan(config, pod)
+	if err != nil || vlan != 0 {
+		return vlan, err
+	}
+	return config.Vlan, nil
+}
+
+// validateTrunk checks the VLANs a trunk port carries. Pods on a trunk tag
+// their own traffic, e.g. virtual routers, and send untagged traffic on
+// NativeVlan if set, or nowhere.
+func validateTrunk(config *RainierConfig) error {
+	if len(config.TrunkVlans) == 0 {
+		if config.NativeVlan != 0 {
+			return fmt.Errorf("nativeVlan needs trunkVlans")
+		}
+		return nil
+	}
+	if config.Vlan != 0 || config.VNI != 0 || len(config.SubnetVlans) > 0 {
+		return fmt.Errorf("trunkVlans cannot be used with vlan, vni or subnetVlans")
+	}
+	for _, vlan := range config.TrunkVlans {
+		if err := validateVlan(vlan); err != nil {
+			return fmt.Errorf("trunkVlans: %v", err)
+		}
+	}
+	if config.NativeVlan != 0 {
+		if err := validateVlan(config.NativeVlan); err != nil {
+			return fmt.Errorf("nativeVlan: %v", err)
+		}
+	}
+	return nil
+}
+
+func setPortTrunk(portName string, trunks []int, native int) error {
+	vlans := []string{}
+	for _, vlan := range trunks {
+		vlans = append(vlans, strconv.Itoa(vlan))
+	}
+	args := []string{"set", "port", portName, "trunks=" + strings.Join(vlans, ",")}
+	if native != 0 {
+		args = append(args, "vlan_mode=native-untagged", "tag="+strconv.Itoa(native))
+	} else {
+		args = append(args, "vlan_mode=trunk")
+	}
+	if _, err := vsctl(args...); err != nil {
+		return fmt.Errorf("Failed to make port %s a trunk of VLANs %s. Error = %s", portName, strings.Join(vlans, ","), err)
+	}
+	return nil
+}
+
+// addTrunkVlanSubinterfacePorts carries every VLAN of the trunk over
+// vlanUplink, when the bridge does not tag on the wire itself
+func addTrunkVlanSubinterfacePorts(config *RainierConfig, key string) error {
+	if config.VlanUplink == "" {
+		return nil
+	}
+	vlans := config.TrunkVlans
+	if config.NativeVlan != 0 {
+		vlans = append([]int{config.NativeVlan}, vlans...)
+	}
+	for _, vlan := range vlans {
+		if err := addVlanSubinterfacePort(config.PublicBridgeName, key, config.VlanUplink, vlan, vlan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestVlanRange(t *testing.T) {
+	tests := []struct {
+		value string
+		first int
+		last  int
+		valid bool
+	}{
+		{"100", 100, 100, true},
+		{"100-199", 100, 199, true},
+		{"1-4094", 1, 4094, true},
+		{"0", 0, 0, false},
+		{"4095", 0, 0, false},
+		{"200-100", 0, 0, false},
+		{"100-", 0, 0, false},
+		{"vlan", 0, 0, false},
+	}
+	for _, test := range tests {
+		first, last, err := vlanRange(test.value)
+		if (err == nil) != test.valid || first != test.first || last != test.last {
+			t.Errorf("vlanRange(%q) = %d, %d, %v, want %d, %d, valid %v",
+				test.value, first, last, err, test.first, test.last, test.valid)
+		}
+	}
+}
+
+func TestVlanAllowed(t *testing.T) {
+	ranges := []string{"100-199", "300"}
+	for vlan, want := range map[int]bool{99: false, 100: true, 199: true, 200: false, 300: true, 301: false} {
+		if got := vlanAllowed(ranges, vlan); got != want {
+			t.Errorf("vlanAllowed(%v, %d) = %v, want %v", ranges, vlan, got, want)
+		}
+	}
+}